@@ -0,0 +1,158 @@
+// abandonment.go detects players who leave a game and do not come back. Once a player has been absent for longer
+// than the grace period, their opponent is notified and can claim victory; if the game has barely started, the
+// claim aborts the game instead.
+
+package gameserver
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type abandonmentConfig struct {
+	// GracePeriod is how long a player may be disconnected before their opponent can claim victory.
+	GracePeriod time.Duration
+	// MinActions is the number of actions below which a claim aborts the game instead of winning it.
+	MinActions int
+}
+
+var (
+	_abandonmentConfig   = abandonmentConfig{GracePeriod: 2 * time.Minute, MinActions: 2}
+	_abandonmentConfigMu sync.RWMutex
+)
+
+func SetAbandonmentConfig(gracePeriod time.Duration, minActions int) {
+	_abandonmentConfigMu.Lock()
+	defer _abandonmentConfigMu.Unlock()
+	_abandonmentConfig = abandonmentConfig{gracePeriod, minActions}
+}
+
+func getAbandonmentConfig() abandonmentConfig {
+	_abandonmentConfigMu.RLock()
+	defer _abandonmentConfigMu.RUnlock()
+	return _abandonmentConfig
+}
+
+type absence struct {
+	since time.Time
+	timer *time.Timer
+}
+
+var (
+	absentPlayers   = make(map[int]map[PlayerType]*absence)
+	absentPlayersMu sync.Mutex
+)
+
+// playerAbsent starts the grace period for a player who no longer has any connection to the game.
+func playerAbsent(gameID int, player PlayerType) {
+	if checkGameStatus(gameID) != nil {
+		return
+	}
+	absentPlayersMu.Lock()
+	defer absentPlayersMu.Unlock()
+
+	if absentPlayers[gameID] == nil {
+		absentPlayers[gameID] = make(map[PlayerType]*absence)
+	}
+	if a := absentPlayers[gameID][player]; a != nil {
+		a.timer.Stop()
+	}
+	absentPlayers[gameID][player] = &absence{
+		since: time.Now(),
+		timer: time.AfterFunc(getAbandonmentConfig().GracePeriod, func() {
+			message, err := newJSONMessage(gameID, "OpponentAbandoned", map[string]string{"player": player.String()})
+			if err == nil {
+				broadcast(gameID, message)
+			}
+		}),
+	}
+}
+
+// playerReturned cancels the grace period of a player who has reconnected to the game.
+func playerReturned(gameID int, player PlayerType) {
+	absentPlayersMu.Lock()
+	defer absentPlayersMu.Unlock()
+
+	if a := absentPlayers[gameID][player]; a != nil {
+		a.timer.Stop()
+		delete(absentPlayers[gameID], player)
+		if len(absentPlayers[gameID]) == 0 {
+			delete(absentPlayers, gameID)
+		}
+	}
+}
+
+func forgetAbsentPlayers(gameID int) {
+	absentPlayersMu.Lock()
+	defer absentPlayersMu.Unlock()
+
+	for _, a := range absentPlayers[gameID] {
+		a.timer.Stop()
+	}
+	delete(absentPlayers, gameID)
+}
+
+// absentSince returns the time since which the player has been absent from the game, or the zero time if unknown.
+// If the player has not been seen since the server started, the last time they were connected to the game is used
+// instead.
+func absentSince(q queryer, gameID int, player PlayerType) (time.Time, error) {
+	absentPlayersMu.Lock()
+	a := absentPlayers[gameID][player]
+	absentPlayersMu.Unlock()
+	if a != nil {
+		return a.since, nil
+	}
+
+	var lastSeen float64
+	err := q.QueryRow("SELECT "+player.String()+"_last_seen FROM games WHERE id = ?", gameID).Scan(&lastSeen)
+	if err != nil || lastSeen == 0 {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(int64(lastSeen)), nil
+}
+
+// claimAbandonment finishes the game because the opponent of the given player has abandoned it,
+// and returns the recorded result.
+func claimAbandonment(gameID int, player PlayerType) (string, error) {
+	var opponent PlayerType
+	switch player {
+	case WhitePlayer:
+		opponent = BlackPlayer
+	case BlackPlayer:
+		opponent = WhitePlayer
+	default:
+		return "", newCodedError(ErrorNotAllowed, "only players can claim victory")
+	}
+	presence, err := getPresence(gameID)
+	if err != nil {
+		return "", err
+	}
+	if (opponent == WhitePlayer && presence.White) || (opponent == BlackPlayer && presence.Black) {
+		return "", newCodedError(ErrorNotAllowed, "the %s player is connected", opponent)
+	}
+	config := getAbandonmentConfig()
+
+	return finishGame(gameID, func(tx *sql.Tx) (string, error) {
+		since, err := absentSince(tx, gameID, opponent)
+		if err != nil {
+			return "", err
+		}
+		if since.IsZero() {
+			return "", newCodedError(ErrorNotAllowed, "the %s player has never been connected", opponent)
+		}
+		if remaining := config.GracePeriod - time.Since(since); remaining > 0 {
+			return "", newCodedError(ErrorNotAllowed, "the %s player may still return for %v", opponent, remaining.Round(time.Second))
+		}
+
+		var numActions int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM actions WHERE game_id = ?", gameID).Scan(&numActions); err != nil {
+			return "", err
+		}
+		if numActions < config.MinActions {
+			return fmt.Sprintf("Aborted: %s abandoned the game", opponent), nil
+		}
+		return fmt.Sprintf("Game won by %s: %s abandoned the game", player, opponent), nil
+	})
+}
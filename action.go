@@ -2,7 +2,6 @@ package gameserver
 
 import (
 	"database/sql"
-	"fmt"
 	"log"
 )
 
@@ -10,23 +9,136 @@ type Action struct {
 	ActionNum int    `json:"action_num"`
 	Action    string `json:"action"`
 	Signature string `json:"signature"`
+	// ClientActionID is an optional id chosen by the client. Resubmitting an action with the same id is accepted
+	// without saving it again.
+	ClientActionID string `json:"client_action_id,omitempty"`
 }
 
-func saveAction(gameID int, actionNum int, action string, signature string) error {
-	_, err := db.Exec("INSERT INTO actions(game_id, action_num, action, action_signature) VALUES(?, ?, ?, ?)",
-		gameID, actionNum, action, signature)
-	return err
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
-func checkActionValidity(gameID int, actionNum int) error {
-	numActions, err := GetNumberOfActions(gameID)
+// appendAction saves the action as the next action of the game, made by the given player. The game status, the
+// action number, the signature and earlier submissions of the same action are checked in the same transaction as the
+// insert, so of several concurrent submissions of the next action exactly one succeeds and the others fail with
+// ErrorConflict. appendAction returns true if the same action had already been saved before.
+//
+// Actions made out of turn fail with ErrorConflict too, but only when the state of the game's rules engine
+// implements TurnState. Otherwise actions are opaque to the server, which cannot assume that players alternate:
+// turns may consist of several actions, such as a move followed by captures, so either player can make the next
+// action.
+func appendAction(gameID int, player PlayerType, action Action) (bool, error) {
+	if player != WhitePlayer && player != BlackPlayer {
+		return false, newCodedError(ErrorNotAllowed, "only players can make actions")
+	}
+	// Whether the game was imported never changes, so it can be checked before the transaction.
+	if err := checkNotImported(db, gameID); err != nil {
+		return false, err
+	}
+	// Whose turn it is only depends on the actions before this one, which cannot change once they have been made,
+	// so it can be checked before the transaction. If they have not all been made yet, the insert fails below.
+	if toMove, err := playerToMove(gameID, action.ActionNum); err != nil && errorCode(err) != ErrorInvalidActionNumber {
+		return false, err
+	} else if err == nil && toMove != Viewer && toMove != player {
+		return false, newCodedError(ErrorConflict, "it is %s's turn to make action %d", toMove, action.ActionNum)
+	}
+	var clientActionID sql.NullString
+	if action.ClientActionID != "" {
+		clientActionID = sql.NullString{String: action.ClientActionID, Valid: true}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// The insert comes first so that the transaction holds the write lock before it reads anything: the checks
+	// below then see exactly the state the insert was made against.
+	result, err := tx.Exec(`
+		INSERT INTO actions(game_id, action_num, action, action_signature, client_action_id, player)
+		SELECT ?, ?, ?, ?, ?, ?
+		WHERE (SELECT game_over FROM games WHERE id = ?) = 0
+			AND (SELECT COUNT(*) FROM actions WHERE game_id = ?) = ?
+			AND NOT EXISTS (SELECT 1 FROM actions WHERE game_id = ? AND client_action_id = ?)
+	`, gameID, action.ActionNum, action.Action, action.Signature, clientActionID, player.String(),
+		gameID, gameID, action.ActionNum-1, gameID, clientActionID)
 	if err != nil {
-		return err
+		return false, err
 	}
-	if actionNum != numActions+1 {
-		return fmt.Errorf("invalid action number: got %d, expected %d", actionNum, numActions+1)
+	if inserted, err := result.RowsAffected(); err != nil {
+		return false, err
+	} else if inserted == 1 {
+		if err := checkActionSignature(tx, gameID, player, action); err != nil {
+			return false, err
+		}
+		if err := chainAction(tx, gameID, player, action); err != nil {
+			return false, err
+		}
+		if err := indexAction(tx, gameID, action.ActionNum); err != nil {
+			return false, err
+		}
+		return false, tx.Commit()
 	}
-	return nil
+
+	duplicate, err := checkResubmission(tx, gameID, action)
+	if err != nil || duplicate {
+		return duplicate, err
+	}
+	var gameOver, numActions int
+	err = tx.QueryRow("SELECT game_over, (SELECT COUNT(*) FROM actions WHERE game_id = games.id) FROM games WHERE id = ?", gameID).
+		Scan(&gameOver, &numActions)
+	if err != nil {
+		return false, err
+	}
+	if gameOver == 1 {
+		return false, newCodedError(ErrorGameOver, "game is over")
+	}
+	if action.ActionNum >= 1 && action.ActionNum <= numActions {
+		return false, newCodedError(ErrorConflict, "action %d has already been made", action.ActionNum)
+	}
+	return false, newCodedError(ErrorInvalidActionNumber, "invalid action number: got %d, expected %d", action.ActionNum, numActions+1)
+}
+
+// checkResubmission checks whether the action has already been saved under its client action id. It returns true
+// if the same action was saved before, and a conflict error if the id or the action number has already been used
+// for a different action.
+func checkResubmission(q queryer, gameID int, action Action) (bool, error) {
+	if action.ClientActionID == "" {
+		return false, nil
+	}
+	existing, err := getActionWhere(q, gameID, "client_action_id = ?", action.ClientActionID)
+	if err != nil {
+		return false, err
+	}
+	if existing != nil {
+		if existing.ActionNum == action.ActionNum && existing.Action == action.Action {
+			return true, nil
+		}
+		return false, newCodedError(ErrorConflict, "action id %q was already used for action %d", action.ClientActionID, existing.ActionNum)
+	}
+	existing, err = getActionWhere(q, gameID, "action_num = ?", action.ActionNum)
+	if err != nil {
+		return false, err
+	}
+	if existing != nil {
+		return false, newCodedError(ErrorConflict, "a different action %d has already been made", action.ActionNum)
+	}
+	return false, nil
+}
+
+// getActionWhere returns the action of the game matching the condition, or nil if there is none.
+func getActionWhere(q queryer, gameID int, condition string, args ...any) (*Action, error) {
+	var action Action
+	err := q.QueryRow("SELECT action_num, action, action_signature, COALESCE(client_action_id, '') FROM actions WHERE game_id = ? AND "+condition,
+		append([]any{gameID}, args...)...).Scan(&action.ActionNum, &action.Action, &action.Signature, &action.ClientActionID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &action, nil
 }
 
 func GetNumberOfActions(gameID int) (int, error) {
@@ -39,7 +151,7 @@ func GetNumberOfActions(gameID int) (int, error) {
 }
 
 func getAllActions(gameID int) ([]Action, error) {
-	rows, err := db.Query("SELECT action_num, action, action_signature FROM actions WHERE game_id = ?", gameID)
+	rows, err := db.Query("SELECT action_num, action, action_signature, COALESCE(client_action_id, '') FROM actions WHERE game_id = ?", gameID)
 	if err == sql.ErrNoRows {
 		return []Action{}, nil
 	} else if err != nil {
@@ -55,10 +167,30 @@ func getAllActions(gameID int) ([]Action, error) {
 	var allActions []Action
 	for rows.Next() {
 		var action Action
-		if err := rows.Scan(&action.ActionNum, &action.Action, &action.Signature); err != nil {
+		if err := rows.Scan(&action.ActionNum, &action.Action, &action.Signature, &action.ClientActionID); err != nil {
 			return nil, err
 		}
 		allActions = append(allActions, action)
 	}
 	return allActions, nil
 }
+
+// getActionsSince returns the actions of the game with numbers greater than actionNum, in order.
+func getActionsSince(gameID int, actionNum int) ([]Action, error) {
+	rows, err := db.Query("SELECT action_num, action, action_signature, COALESCE(client_action_id, '') FROM actions WHERE game_id = ? AND action_num > ? ORDER BY action_num",
+		gameID, actionNum)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	allActions := []Action{}
+	for rows.Next() {
+		var action Action
+		if err := rows.Scan(&action.ActionNum, &action.Action, &action.Signature, &action.ClientActionID); err != nil {
+			return nil, err
+		}
+		allActions = append(allActions, action)
+	}
+	return allActions, rows.Err()
+}
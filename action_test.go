@@ -1,11 +1,38 @@
 package gameserver_test
 
 import (
+	"encoding/json"
+	"fmt"
 	"testing"
 
 	"github.com/vkryukov/gameserver"
 )
 
+// connect6Rules is a rules engine for a game where white makes the first action, and then the players take turns
+// making two actions each.
+type connect6Rules struct{}
+
+type connect6State int
+
+func (connect6Rules) InitialState() gameserver.GameState {
+	return connect6State(0)
+}
+
+func (s connect6State) Apply(action string) (gameserver.GameState, error) {
+	return s + 1, nil
+}
+
+func (s connect6State) ToMove() gameserver.PlayerType {
+	if s == 0 || (s-1)/2%2 == 1 {
+		return gameserver.WhitePlayer
+	}
+	return gameserver.BlackPlayer
+}
+
+func init() {
+	gameserver.RegisterRulesEngine("Connect6", connect6Rules{})
+}
+
 func TestNumberOfActionsForNewGame(t *testing.T) {
 	user1 := mustRegisterAndAuthenticateUser(t, "user1-new-game-creating@example.com", "user1-ws-password", "user1-actiongame1")
 	user2 := mustRegisterAndAuthenticateUser(t, "user2-new-game-creating@example.com", "user2-ws-password", "user2-actiongame2")
@@ -20,3 +47,62 @@ func TestNumberOfActionsForNewGame(t *testing.T) {
 		t.Fatalf("Number of actions for new game is not 0 but %d", num)
 	}
 }
+
+func TestTurns(t *testing.T) {
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user1, true, true)
+	mustJoinGame(t, user2, game)
+	conn := mustDialWS(t)
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user2.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, conn, "GameJoined")
+
+	// Test 1: without a rules engine that knows whose turn it is, either player can make the next action
+	var resp struct {
+		ActionNum int                  `json:"action_num"`
+		Error     string               `json:"error"`
+		ErrorCode gameserver.ErrorCode `json:"error_code"`
+	}
+	data, _ := json.Marshal(&gameserver.Action{ActionNum: 1, Action: "a"})
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user2.Token, Type: "Action", Message: string(data)})
+	mustReadWSMessageOfType(t, conn, "ActionAccepted")
+	url := fmt.Sprintf("http://localhost:1234/game/%d/actions", game.Id)
+	mustDecodeRequestWithObject(t, url, map[string]interface{}{"token": user2.Token, "action_num": 2, "action": "b"}, &resp)
+	if resp.Error != "" {
+		t.Fatalf("Expected black's second action to be accepted, got %+v", resp)
+	}
+
+	// Test 2: the rules engine decides whose turn it is when it knows
+	connect6, err := gameserver.CreateGame(&gameserver.Game{Type: "Connect6", WhitePlayer: user1.ScreenName, WhiteToken: user1.Token, Public: true})
+	if err != nil {
+		t.Fatalf("Failed to create game: %v", err)
+	}
+	mustJoinGame(t, user2, connect6)
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: connect6.Id, Token: user2.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, conn, "GameJoined")
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: connect6.Id, Token: user2.Token, Type: "Action", Message: string(data)})
+	if resp := mustReadWSMessageOfType(t, conn, "Error"); resp.ErrorCode != gameserver.ErrorConflict {
+		t.Fatalf("Expected black's action to be refused, got %s", mustPrettyPrint(t, resp))
+	}
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: connect6.Id, Token: user1.Token, Type: "Action", Message: string(data)})
+	mustReadWSMessageOfType(t, conn, "ActionAccepted")
+
+	// Test 3: actions made over HTTP are checked too
+	url = fmt.Sprintf("http://localhost:1234/game/%d/actions", connect6.Id)
+	for i, turn := range []struct {
+		user    *gameserver.User
+		allowed bool
+	}{{user1, false}, {user2, true}, {user2, true}, {user2, false}, {user1, true}} {
+		num := 1
+		if n, err := gameserver.GetNumberOfActions(connect6.Id); err == nil {
+			num = n + 1
+		}
+		resp.Error, resp.ErrorCode = "", ""
+		mustDecodeRequestWithObject(t, url, map[string]interface{}{"token": turn.user.Token, "action_num": num, "action": "x"}, &resp)
+		if turn.allowed && resp.Error != "" {
+			t.Fatalf("Expected attempt %d to be accepted, got %+v", i+1, resp)
+		} else if !turn.allowed && resp.ErrorCode != gameserver.ErrorConflict {
+			t.Fatalf("Expected attempt %d to be refused, got %+v", i+1, resp)
+		}
+	}
+}
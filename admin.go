@@ -7,6 +7,8 @@ import (
 func RegisterAdminHandlers(prefix, baseURL string) {
 	http.HandleFunc(baseURL+prefix+"/users", Middleware(handleListUsers))
 	http.HandleFunc(baseURL+prefix+"/games", Middleware(handleListGames))
+	http.HandleFunc(baseURL+prefix+"/connections", Middleware(handleConnectionStats))
+	http.HandleFunc(baseURL+prefix+"/import", Middleware(handleImportGame))
 }
 
 func handleListUsers(w http.ResponseWriter, r *http.Request) {
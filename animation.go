@@ -0,0 +1,449 @@
+// animation.go exports finished games as animated GIFs, with one frame for each position of the game, drawn like
+// the diagrams of diagram.go. Animations are generated in the background on the first request, a few at a time, and
+// cached on disk, the least recently served being removed when the cache grows too large.
+
+package gameserver
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAnimationSize  = 400
+	defaultAnimationDelay = 1000 // in milliseconds
+	// maxAnimationRenders is the number of animations generated at the same time.
+	maxAnimationRenders = 2
+	// maxAnimationJobs is the number of animations waiting to be generated or to have their failure reported.
+	maxAnimationJobs = 32
+	// maxAnimationPixels bounds the memory taken by an animation while it is generated: its frames are kept until
+	// they are encoded, and take a byte per pixel.
+	maxAnimationPixels = 64 << 20
+)
+
+// The sizes and delays of animations are limited to a few presets, so that each game has a few animations at most.
+var (
+	animationSizes  = []int{200, 400, 800}
+	animationDelays = []int{250, 500, 1000, 2000}
+)
+
+var (
+	animationCacheDir = filepath.Join(os.TempDir(), "gameserver-animations")
+	// animationCacheLimit is the total size in bytes of the cached animations.
+	animationCacheLimit int64 = 256 << 20
+	// animationJobs are the animations being generated, and the errors of those that failed, by cache file.
+	animationJobs   = make(map[string]error)
+	animationJobsMu sync.Mutex
+	// animationRenders holds a slot for each animation being generated.
+	animationRenders = make(chan struct{}, maxAnimationRenders)
+)
+
+// SetAnimationCacheDir sets the directory where animations are cached.
+func SetAnimationCacheDir(dir string) {
+	animationJobsMu.Lock()
+	defer animationJobsMu.Unlock()
+	animationCacheDir = dir
+}
+
+// SetAnimationCacheLimit sets the total size in bytes of the cached animations.
+func SetAnimationCacheLimit(limit int64) {
+	animationJobsMu.Lock()
+	defer animationJobsMu.Unlock()
+	animationCacheLimit = limit
+}
+
+// AnimationOptions are the options of an animation.
+type AnimationOptions struct {
+	// Size is the width of the animation in pixels.
+	Size int
+	// Delay is the time each position is shown, in milliseconds. The final position is shown three times as long.
+	Delay    int
+	Flipped  bool
+	LastMove bool
+}
+
+func (options AnimationOptions) check() error {
+	if !slices.Contains(animationSizes, options.Size) {
+		return fmt.Errorf("the size must be one of %v pixels", animationSizes)
+	}
+	if !slices.Contains(animationDelays, options.Delay) {
+		return fmt.Errorf("the delay must be one of %v milliseconds", animationDelays)
+	}
+	return nil
+}
+
+// cacheFile returns the name of the file the animation of the game is cached in.
+func (options AnimationOptions) cacheFile(gameID int) string {
+	return fmt.Sprintf("game-%d-%d-%d-%t-%t.gif", gameID, options.Size, options.Delay, options.Flipped, options.LastMove)
+}
+
+// diagramColors are the colors of the diagrams, which come first in the palette of the animations.
+var diagramColors = map[string]color.RGBA{
+	"background": {0xf2, 0xdf, 0xb4, 0xff},
+	"line":       {0x5a, 0x4a, 0x32, 0xff},
+	"white":      {0xfa, 0xfa, 0xfa, 0xff},
+	"black":      {0x22, 0x22, 0x22, 0xff},
+	"highlight":  {0xf7, 0xc9, 0x48, 0xff},
+}
+
+var animationPalette = func() color.Palette {
+	colors := color.Palette{}
+	for _, name := range []string{"background", "line", "white", "black", "highlight"} {
+		colors = append(colors, diagramColors[name])
+	}
+	return append(colors, palette.WebSafe...)
+}()
+
+// pieceColor returns the color of a piece, given as a name or in the #rgb or #rrggbb notations.
+func pieceColor(name string) color.RGBA {
+	if c, ok := diagramColors[name]; ok {
+		return c
+	}
+	var r, g, b uint8
+	if _, err := fmt.Sscanf(name, "#%02x%02x%02x", &r, &g, &b); err == nil && len(name) == 7 {
+		return color.RGBA{r, g, b, 0xff}
+	}
+	if _, err := fmt.Sscanf(name, "#%1x%1x%1x", &r, &g, &b); err == nil && len(name) == 4 {
+		return color.RGBA{r * 0x11, g * 0x11, b * 0x11, 0xff}
+	}
+	return color.RGBA{0x88, 0x88, 0x88, 0xff}
+}
+
+// paint blends the color into the pixels of the image within the bounds, according to their coverage.
+func paint(img *image.RGBA, bounds image.Rectangle, c color.RGBA, coverage func(x, y float64) float64) {
+	bounds = bounds.Intersect(img.Bounds())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			alpha := math.Max(0, math.Min(1, coverage(float64(x)+0.5, float64(y)+0.5)))
+			if alpha == 0 {
+				continue
+			}
+			old := img.RGBAAt(x, y)
+			blend := func(a, b uint8) uint8 { return uint8(float64(a)*(1-alpha) + float64(b)*alpha + 0.5) }
+			img.SetRGBA(x, y, color.RGBA{blend(old.R, c.R), blend(old.G, c.G), blend(old.B, c.B), 0xff})
+		}
+	}
+}
+
+func circleBounds(cx, cy, r float64) image.Rectangle {
+	return image.Rect(int(cx-r-1), int(cy-r-1), int(cx+r+2), int(cy+r+2))
+}
+
+func fillCircle(img *image.RGBA, cx, cy, r float64, c color.RGBA) {
+	paint(img, circleBounds(cx, cy, r), c, func(x, y float64) float64 {
+		return r - math.Hypot(x-cx, y-cy) + 0.5
+	})
+}
+
+func strokeCircle(img *image.RGBA, cx, cy, r, width float64, c color.RGBA) {
+	paint(img, circleBounds(cx, cy, r+width), c, func(x, y float64) float64 {
+		return width/2 - math.Abs(math.Hypot(x-cx, y-cy)-r) + 0.5
+	})
+}
+
+func strokeLine(img *image.RGBA, x1, y1, x2, y2, width float64, c color.RGBA) {
+	bounds := image.Rect(int(math.Min(x1, x2)-width), int(math.Min(y1, y2)-width),
+		int(math.Max(x1, x2)+width+1), int(math.Max(y1, y2)+width+1))
+	length := math.Hypot(x2-x1, y2-y1)
+	paint(img, bounds, c, func(x, y float64) float64 {
+		// The distance from the point to the segment.
+		t := math.Max(0, math.Min(1, ((x-x1)*(x2-x1)+(y-y1)*(y2-y1))/(length*length)))
+		return width/2 - math.Hypot(x-x1-t*(x2-x1), y-y1-t*(y2-y1)) + 0.5
+	})
+}
+
+// rasterizeBoard draws the board like DrawBoard, without coordinates, as an image of the given width.
+func rasterizeBoard(board *Board, flipped bool, lastMove []string, width int) *image.Paletted {
+	diagramWidth, diagramHeight := board.diagramSize()
+	scale := float64(width) / diagramWidth
+	img := image.NewRGBA(image.Rect(0, 0, width, int(diagramHeight*scale+0.5)))
+	draw.Draw(img, img.Bounds(), image.NewUniform(diagramColors["background"]), image.Point{}, draw.Src)
+
+	points := board.points(flipped)
+	for i := range points {
+		points[i].x *= scale
+		points[i].y *= scale
+	}
+	for i, p := range points {
+		for _, q := range points[i+1:] {
+			if (!p.edge || !q.edge) && math.Hypot(p.x-q.x, p.y-q.y) < diagramSpacing*scale*1.01 {
+				strokeLine(img, p.x, p.y, q.x, q.y, 1.5*scale, diagramColors["line"])
+			}
+		}
+	}
+	highlighted := make(map[string]bool)
+	for _, name := range lastMove {
+		highlighted[name] = true
+	}
+	for _, p := range points {
+		if p.edge {
+			fillCircle(img, p.x, p.y, 3*scale, diagramColors["line"])
+		}
+		if highlighted[p.name] {
+			fillCircle(img, p.x, p.y, diagramSpacing*0.48*scale, diagramColors["highlight"])
+		}
+		piece, ok := board.Pieces[p.name]
+		if !ok {
+			continue
+		}
+		if piece.Ring {
+			strokeCircle(img, p.x, p.y, diagramSpacing*0.36*scale, 6*scale, pieceColor(piece.Color))
+		} else {
+			fillCircle(img, p.x, p.y, diagramSpacing*0.4*scale, diagramColors["black"])
+			fillCircle(img, p.x, p.y, (diagramSpacing*0.4-1.5)*scale, pieceColor(piece.Color))
+		}
+		// Without fonts, the height of stacks is shown by concentric rings.
+		ringColor := diagramColors["line"]
+		if piece.Color == "black" {
+			ringColor = diagramColors["white"]
+		}
+		for level := 1; level < piece.Height && level < 4; level++ {
+			strokeCircle(img, p.x, p.y, diagramSpacing*(0.4-0.08*float64(level))*scale, scale, ringColor)
+		}
+	}
+
+	paletted := image.NewPaletted(img.Bounds(), animationPalette)
+	draw.Draw(paletted, paletted.Bounds(), img, image.Point{}, draw.Src)
+	return paletted
+}
+
+// AnimateGame returns the animated GIF of a finished game.
+func AnimateGame(gameID int, options AnimationOptions) ([]byte, error) {
+	if err := options.check(); err != nil {
+		return nil, err
+	}
+	game, err := GetGameWithId(gameID)
+	if err != nil {
+		return nil, err
+	}
+	if !game.GameOver {
+		return nil, newCodedError(ErrorNotAllowed, "only finished games can be animated")
+	}
+	engine := getRulesEngine(game.Type)
+	if engine == nil {
+		return nil, newCodedError(ErrorUnavailable, "no rules engine for games of type %s", game.Type)
+	}
+	actions, err := getRecordActions(gameID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The positions are computed by replaying the actions once, rather than with GetPosition for each of them.
+	state := engine.InitialState()
+	var previous *Board
+	animation := &gif.GIF{}
+	for i := 0; ; i++ {
+		boardState, ok := state.(BoardState)
+		if !ok {
+			return nil, newCodedError(ErrorUnavailable, "positions of game %d cannot be drawn", gameID)
+		}
+		board := boardState.Board()
+		var lastMove []string
+		if options.LastMove && previous != nil {
+			lastMove = changedPoints(previous, board)
+		}
+		frame := rasterizeBoard(board, options.Flipped, lastMove, options.Size)
+		if i == 0 && len(frame.Pix)*(len(actions)+1) > maxAnimationPixels {
+			return nil, newCodedError(ErrorUnavailable, "game %d has too many positions to be animated at %d pixels",
+				gameID, options.Size)
+		}
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, options.Delay/10)
+		if i == len(actions) {
+			break
+		}
+		previous = board
+		if state, err = state.Apply(actions[i].Action); err != nil {
+			return nil, fmt.Errorf("action %d (%s) is not legal: %v", i+1, actions[i].Action, err)
+		}
+	}
+	animation.Delay[len(animation.Delay)-1] *= 3
+
+	var data bytes.Buffer
+	if err := gif.EncodeAll(&data, animation); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// cachedAnimation returns the path of the cached animation of the game, or an empty path if it is not ready yet,
+// in which case it is generated in the background.
+func cachedAnimation(gameID int, options AnimationOptions) (string, error) {
+	animationJobsMu.Lock()
+	defer animationJobsMu.Unlock()
+	path := filepath.Join(animationCacheDir, options.cacheFile(gameID))
+	if _, err := os.Stat(path); err == nil {
+		// The modification time of the cached animations is the last time they were served.
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return path, nil
+	}
+	if err, ok := animationJobs[path]; ok {
+		if err != nil {
+			// Report the failure once, so that the next request tries again.
+			delete(animationJobs, path)
+		}
+		return "", err
+	}
+	if len(animationJobs) >= maxAnimationJobs {
+		// Failures that were never reported make room for new animations first.
+		for path, err := range animationJobs {
+			if err != nil {
+				delete(animationJobs, path)
+			}
+		}
+		if len(animationJobs) >= maxAnimationJobs {
+			return "", newCodedError(ErrorUnavailable, "too many animations are being generated, try again later")
+		}
+	}
+
+	animationJobs[path] = nil
+	limit := animationCacheLimit
+	go func() {
+		animationRenders <- struct{}{}
+		err := writeAnimation(path, gameID, options)
+		<-animationRenders
+		animationJobsMu.Lock()
+		defer animationJobsMu.Unlock()
+		if err != nil {
+			animationJobs[path] = err
+			return
+		}
+		delete(animationJobs, path)
+		if err := pruneAnimationCache(filepath.Dir(path), limit, path); err != nil {
+			log.Printf("Error pruning the animation cache: %v", err)
+		}
+	}()
+	return "", nil
+}
+
+// pruneAnimationCache removes the least recently served animations from the cache directory until their total
+// size is within the limit, keeping the animation that was just generated.
+func pruneAnimationCache(dir string, limit int64, keep string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	var size int64
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".gif" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+		size += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, info := range files {
+		if size <= limit {
+			break
+		}
+		path := filepath.Join(dir, info.Name())
+		if path == keep {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		size -= info.Size()
+	}
+	return nil
+}
+
+// writeAnimation generates the animation and writes it to the file, atomically.
+func writeAnimation(path string, gameID int, options AnimationOptions) error {
+	data, err := AnimateGame(gameID, options)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), "animation-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// animationHandler serves GET prefix/{id}/animation.gif, which returns the animation of a finished game. The "size"
+// and "delay" query parameters set the width in pixels (200, 400 or 800) and the delay between positions in
+// milliseconds (250, 500, 1000 or 2000), and the "orientation" and "lastmove" parameters work like those of the
+// diagrams. While the animation is being generated, the response is {"status": "pending"} with the status code 202,
+// and the client should try again later.
+func animationHandler(w http.ResponseWriter, r *http.Request, gameID int) {
+	game, err := GetGameWithId(gameID)
+	if err != nil {
+		sendError(w, serverError("cannot find game", err))
+		return
+	}
+	if !canWatch(r, game) {
+		sendError(w, serverError("invalid token", nil))
+		return
+	}
+	query := r.URL.Query()
+	options := AnimationOptions{
+		Size:     defaultAnimationSize,
+		Delay:    defaultAnimationDelay,
+		Flipped:  query.Get("orientation") == "black",
+		LastMove: query.Get("lastmove") == "1" || query.Get("lastmove") == "true",
+	}
+	for name, value := range map[string]*int{"size": &options.Size, "delay": &options.Delay} {
+		if param := query.Get(name); param != "" {
+			if *value, err = strconv.Atoi(param); err != nil {
+				sendError(w, serverError("invalid "+name, err))
+				return
+			}
+		}
+	}
+	if err := options.check(); err != nil {
+		sendError(w, err)
+		return
+	}
+	if !game.GameOver {
+		sendCodedError(w, newCodedError(ErrorNotAllowed, "only finished games can be animated"))
+		return
+	}
+
+	path, err := cachedAnimation(gameID, options)
+	if err != nil {
+		sendCodedError(w, err)
+		return
+	}
+	if path == "" {
+		w.Header().Set("Retry-After", "1")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status": "pending"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	http.ServeFile(w, r, path)
+}
@@ -0,0 +1,107 @@
+package gameserver_test
+
+import (
+	"bytes"
+	"fmt"
+	"image/gif"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vkryukov/gameserver"
+)
+
+// mustGetAnimation polls for the animation of the game until it is ready, and returns the response body.
+func mustGetAnimation(t *testing.T, gameID int, query string) (int, []byte) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:1234/game/%d/animation.gif?%s", gameID, query))
+		if err != nil {
+			t.Fatalf("Failed to get animation: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Failed to read animation: %v", err)
+		}
+		if resp.StatusCode != http.StatusAccepted {
+			return resp.StatusCode, body
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The animation of game %d is still pending", gameID)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestGameAnimation(t *testing.T) {
+	dir := t.TempDir()
+	gameserver.SetAnimationCacheDir(dir)
+
+	// Test 1: the animation has a frame for each position, and is cached
+	game := mustImportGame(t, "(;\nGM[Placing]\n; P0[1 e5]\n; P1[2 b2]\n; P0[3 f6]\nRE[Draw]\n)\n", gameserver.FormatBoardspace)
+	status, body := mustGetAnimation(t, game.Id, "size=200&delay=250&lastmove=1")
+	if status != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", status, body)
+	}
+	animation, err := gif.DecodeAll(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to decode animation: %v", err)
+	}
+	if len(animation.Image) != 4 || animation.Config.Width != 200 || animation.Delay[0] != 25 || animation.Delay[3] != 75 {
+		t.Fatalf("Unexpected animation: %d frames, width %d, delays %v", len(animation.Image), animation.Config.Width,
+			animation.Delay)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil || len(files) != 1 || !strings.HasSuffix(files[0].Name(), ".gif") {
+		t.Fatalf("Expected the animation to be cached, got %v (%v)", files, err)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://localhost:1234/game/%d/animation.gif?size=200&delay=250&lastmove=1", game.Id))
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/gif" {
+		t.Fatalf("Expected the cached animation to be served at once, got %v (%v)", resp, err)
+	}
+	resp.Body.Close()
+
+	// Test 2: the options are limited to presets
+	if _, body := mustGetAnimation(t, game.Id, "size=5000"); !isErrorResponse(body, "size") {
+		t.Fatalf("Expected an invalid size error, got %s", body)
+	}
+	if _, body := mustGetAnimation(t, game.Id, "delay=300"); !isErrorResponse(body, "delay") {
+		t.Fatalf("Expected an invalid delay error, got %s", body)
+	}
+
+	// Test 3: only finished games with drawable positions can be animated
+	unfinished := mustImportGame(t, "(;\nGM[Placing]\n; P0[1 e5]\n)\n", gameserver.FormatBoardspace)
+	if _, body := mustGetAnimation(t, unfinished.Id, ""); !strings.Contains(string(body), string(gameserver.ErrorNotAllowed)) {
+		t.Fatalf("Expected an error for an unfinished game, got %s", body)
+	}
+	counting := mustImportGame(t, "(;\nGM[Counting]\n; P0[1 1]\nRE[Draw]\n)\n", gameserver.FormatBoardspace)
+	if _, body := mustGetAnimation(t, counting.Id, ""); !strings.Contains(string(body), string(gameserver.ErrorUnavailable)) {
+		t.Fatalf("Expected an error for a game without a board, got %s", body)
+	}
+	// Test 4: long games can only be animated at small sizes
+	var long strings.Builder
+	long.WriteString("(;\nGM[Placing]\n")
+	for i := 1; i <= 200; i++ {
+		fmt.Fprintf(&long, "; P%d[%d p%d]\n", (i+1)%2, i, i)
+	}
+	long.WriteString("RE[Draw]\n)\n")
+	game200 := mustImportGame(t, long.String(), gameserver.FormatBoardspace)
+	if _, body := mustGetAnimation(t, game200.Id, "size=800"); !strings.Contains(string(body), "too many positions") {
+		t.Fatalf("Expected an error for a long game, got %.200s", body)
+	}
+
+	// Test 5: the least recently served animations are removed when the cache grows too large
+	gameserver.SetAnimationCacheLimit(int64(len(body)) + 1)
+	defer gameserver.SetAnimationCacheLimit(256 << 20)
+	if status, body := mustGetAnimation(t, game.Id, "size=400"); status != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", status, body)
+	}
+	files, err = os.ReadDir(dir)
+	if err != nil || len(files) != 1 || !strings.Contains(files[0].Name(), "-400-") {
+		t.Fatalf("Expected only the last animation to be cached, got %v (%v)", files, err)
+	}
+}
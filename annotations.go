@@ -0,0 +1,340 @@
+// annotations.go implements annotations of finished games: comments, evaluation symbols, and alternative lines of
+// play attached to actions of a game. They are stored separately from the actions, and are included in the exported
+// records.
+//
+// An annotation of the main line refers to an action of the game. An annotation with a parent refers to an action of
+// the variation of its parent instead, numbered as if the variation had been played in the game. An annotation with a
+// variation proposes it as an alternative to the action it refers to, so nested annotations form a tree of variations.
+
+package gameserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Annotation is a comment, an evaluation symbol, or a variation attached to an action.
+type Annotation struct {
+	Id        int    `json:"id"`
+	GameID    int    `json:"game_id"`
+	ActionNum int    `json:"action_num"`
+	ParentID  int    `json:"parent_id,omitempty"`
+	Author    string `json:"author"`
+	Comment   string `json:"comment,omitempty"`
+	Symbol    string `json:"symbol,omitempty"`
+	// Variation is the sequence of actions played instead of the action the annotation refers to.
+	Variation []string `json:"variation,omitempty"`
+	// Players are the players who make the actions of the variation, "white" or "black". They are given by the rules
+	// engine of the game when it knows whose turn it is, and can be given by the author otherwise; by default, white
+	// makes the odd actions and black the even ones.
+	Players      []string `json:"players,omitempty"`
+	CreationTime int      `json:"creation_time"`
+}
+
+type annotationSymbol struct {
+	nag int    // the Numeric Annotation Glyph of the symbol in PGN
+	sgf string // the SGF property of the symbol
+}
+
+// annotationSymbols are the evaluation symbols of actions and positions that annotations can have.
+var annotationSymbols = map[string]annotationSymbol{
+	"!":  {1, "TE[1]"},
+	"?":  {2, "BM[1]"},
+	"!!": {3, "TE[2]"},
+	"??": {4, "BM[2]"},
+	"!?": {5, "IT[]"},
+	"?!": {6, "DO[]"},
+	"=":  {10, "DM[1]"},
+	"∞":  {13, "UC[1]"},
+	"+=": {14, "GW[1]"},
+	"=+": {15, "GB[1]"},
+	"+-": {18, "GW[2]"},
+	"-+": {19, "GB[2]"},
+}
+
+// canAnnotate returns the author name of the user or player with the token, if they can annotate the game.
+// Players can always annotate their games; other users can annotate public games with open annotations.
+func canAnnotate(game *Game, token Token) (string, error) {
+	player, _ := validateGameToken(game.Id, token)
+	user, err := GetUserWithToken(token)
+	switch {
+	case player == WhitePlayer || player == BlackPlayer:
+		if err == nil {
+			return user.ScreenName, nil
+		}
+		if player == WhitePlayer && game.WhitePlayer != "" {
+			return game.WhitePlayer, nil
+		}
+		if player == BlackPlayer && game.BlackPlayer != "" {
+			return game.BlackPlayer, nil
+		}
+		return player.String(), nil
+	case err != nil:
+		return "", fmt.Errorf("invalid token")
+	case !game.Public || !game.OpenAnnotations:
+		return "", newCodedError(ErrorNotAllowed, "only the players can annotate this game")
+	}
+	return user.ScreenName, nil
+}
+
+// AddAnnotation checks the annotation and adds it to its game.
+func AddAnnotation(annotation *Annotation) error {
+	if annotation.Comment == "" && annotation.Symbol == "" && len(annotation.Variation) == 0 {
+		return fmt.Errorf("the annotation is empty")
+	}
+	if _, ok := annotationSymbols[annotation.Symbol]; annotation.Symbol != "" && !ok {
+		return fmt.Errorf("unknown symbol %q", annotation.Symbol)
+	}
+	for _, action := range annotation.Variation {
+		if strings.TrimSpace(action) == "" || strings.ContainsAny(action, "\n(){}") {
+			return fmt.Errorf("invalid action %q in the variation", action)
+		}
+	}
+	game, err := GetGameWithId(annotation.GameID)
+	if err != nil {
+		return err
+	}
+	if !game.GameOver {
+		return newCodedError(ErrorNotAllowed, "only finished games can be annotated")
+	}
+
+	// line is the sequence of actions leading to the action the annotation refers to.
+	line, err := annotationLine(game, annotation.ParentID, annotation.ActionNum)
+	if err != nil {
+		return err
+	}
+	annotation.Players, err = variationPlayers(game, line, annotation)
+	if err != nil {
+		return err
+	}
+
+	variation, err := json.Marshal(annotation.Variation)
+	if err != nil {
+		return err
+	}
+	players, err := json.Marshal(annotation.Players)
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec(`
+		INSERT INTO annotations(game_id, action_num, parent_id, author, comment, symbol, variation, variation_players)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)
+	`, annotation.GameID, annotation.ActionNum, annotation.ParentID, annotation.Author, annotation.Comment, annotation.Symbol,
+		string(variation), string(players))
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	annotation.Id = int(id)
+	return nil
+}
+
+// variationPlayers checks the variation of the annotation with the rules engine of the game, if there is one, and
+// returns the players who make its actions.
+func variationPlayers(game *Game, line []string, annotation *Annotation) ([]string, error) {
+	if len(annotation.Variation) == 0 {
+		return nil, nil
+	}
+	var players []string
+	if engine := getRulesEngine(game.Type); engine != nil {
+		state, err := replayActions(engine, line)
+		if err != nil {
+			return nil, err
+		}
+		for i, action := range annotation.Variation {
+			if turnState, ok := state.(TurnState); ok {
+				players = append(players, turnState.ToMove().String())
+			}
+			if state, err = state.Apply(action); err != nil {
+				return nil, fmt.Errorf("invalid variation: action %d (%s) is not legal: %v", annotation.ActionNum+i, action, err)
+			}
+		}
+		if len(players) == len(annotation.Variation) {
+			return players, nil
+		}
+	}
+	if len(annotation.Players) > 0 {
+		if len(annotation.Players) != len(annotation.Variation) {
+			return nil, fmt.Errorf("expected the players of %d actions, got %d", len(annotation.Variation), len(annotation.Players))
+		}
+		for _, player := range annotation.Players {
+			if player != WhitePlayer.String() && player != BlackPlayer.String() {
+				return nil, fmt.Errorf("invalid player %q", player)
+			}
+		}
+		return annotation.Players, nil
+	}
+	for i := range annotation.Variation {
+		players = append(players, defaultPlayer(annotation.ActionNum+i).String())
+	}
+	return players, nil
+}
+
+// annotationLine returns the actions played before the action actionNum of the line of the annotation parentID,
+// or of the main line if parentID is 0.
+func annotationLine(game *Game, parentID, actionNum int) ([]string, error) {
+	if parentID == 0 {
+		if actionNum < 1 || actionNum > game.NumActions {
+			return nil, newCodedError(ErrorInvalidActionNumber, "game %d has no action %d", game.Id, actionNum)
+		}
+		actions, err := getRecordActions(game.Id)
+		if err != nil {
+			return nil, err
+		}
+		line := make([]string, actionNum-1)
+		for i := range line {
+			line[i] = actions[i].Action
+		}
+		return line, nil
+	}
+	parent, err := getAnnotation(parentID)
+	if err != nil || parent.GameID != game.Id || len(parent.Variation) == 0 {
+		return nil, fmt.Errorf("annotation %d has no variation in game %d", parentID, game.Id)
+	}
+	if actionNum < parent.ActionNum || actionNum >= parent.ActionNum+len(parent.Variation) {
+		return nil, newCodedError(ErrorInvalidActionNumber, "the variation of annotation %d has no action %d", parentID,
+			actionNum)
+	}
+	line, err := annotationLine(game, parent.ParentID, parent.ActionNum)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, parent.Variation[:actionNum-parent.ActionNum]...), nil
+}
+
+func getAnnotation(id int) (*Annotation, error) {
+	annotations, err := getAnnotationsWhere("id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(annotations) == 0 {
+		return nil, fmt.Errorf("cannot find annotation %d", id)
+	}
+	return annotations[0], nil
+}
+
+// GetAnnotations returns the annotations of the game in the order they were made.
+func GetAnnotations(gameID int) ([]*Annotation, error) {
+	return getAnnotationsWhere("game_id = ?", gameID)
+}
+
+func getAnnotationsWhere(condition string, args ...any) ([]*Annotation, error) {
+	rows, err := db.Query(`
+		SELECT id, game_id, action_num, parent_id, author, comment, symbol, variation, variation_players, creation_time
+		FROM annotations WHERE `+condition+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	annotations := []*Annotation{}
+	for rows.Next() {
+		var annotation Annotation
+		var variation, players string
+		var creationTime float64
+		err := rows.Scan(&annotation.Id, &annotation.GameID, &annotation.ActionNum, &annotation.ParentID, &annotation.Author,
+			&annotation.Comment, &annotation.Symbol, &variation, &players, &creationTime)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(variation), &annotation.Variation); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(players), &annotation.Players); err != nil {
+			return nil, err
+		}
+		annotation.CreationTime = int(creationTime)
+		annotations = append(annotations, &annotation)
+	}
+	return annotations, rows.Err()
+}
+
+// annotationTree indexes the annotations of a game by their parent and the action they refer to.
+type annotationTree map[[2]int][]*Annotation
+
+func newAnnotationTree(annotations []*Annotation) annotationTree {
+	tree := make(annotationTree)
+	for _, annotation := range annotations {
+		key := [2]int{annotation.ParentID, annotation.ActionNum}
+		tree[key] = append(tree[key], annotation)
+	}
+	return tree
+}
+
+// at returns the annotations of the action actionNum in the line of the annotation parentID.
+func (tree annotationTree) at(parentID, actionNum int) []*Annotation {
+	return tree[[2]int{parentID, actionNum}]
+}
+
+// annotationsHandler serves prefix/{id}/annotations. GET returns the annotations of the game, and POST adds one
+// with a body like {token, action_num, parent_id, comment, symbol, variation}.
+func annotationsHandler(w http.ResponseWriter, r *http.Request, gameID int) {
+	game, err := GetGameWithId(gameID)
+	if err != nil {
+		sendError(w, serverError("cannot find game", err))
+		return
+	}
+	if r.Method != http.MethodPost {
+		if !canWatch(r, game) {
+			sendError(w, serverError("invalid token", nil))
+			return
+		}
+		annotations, err := GetAnnotations(gameID)
+		if err != nil {
+			sendError(w, serverError("cannot get annotations", err))
+			return
+		}
+		writeJSONResponse(w, annotations)
+		return
+	}
+
+	var request struct {
+		Token Token `json:"token"`
+		Annotation
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendError(w, serverError("incorrect request", err))
+		return
+	}
+	annotation := request.Annotation
+	annotation.GameID = gameID
+	annotation.Author, err = canAnnotate(game, request.Token)
+	if err == nil {
+		err = AddAnnotation(&annotation)
+	}
+	if err != nil {
+		sendCodedError(w, err)
+		return
+	}
+	writeJSONResponse(w, annotation)
+}
+
+// SetOpenAnnotations lets registered users other than the players annotate the game, or stops them from doing so.
+func SetOpenAnnotations(gameID int, open bool) error {
+	_, err := db.Exec("UPDATE games SET open_annotations = ? WHERE id = ?", open, gameID)
+	return err
+}
+
+func openAnnotationsHandler(w http.ResponseWriter, r *http.Request, gameID int) {
+	var request struct {
+		Token           Token `json:"token"`
+		OpenAnnotations bool  `json:"open_annotations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendError(w, serverError("incorrect request", err))
+		return
+	}
+	if player, _ := validateGameToken(gameID, request.Token); player != WhitePlayer && player != BlackPlayer {
+		sendCodedError(w, newCodedError(ErrorNotAllowed, "only the players can open or close annotations"))
+		return
+	}
+	if err := SetOpenAnnotations(gameID, request.OpenAnnotations); err != nil {
+		sendError(w, serverError("cannot update game", err))
+		return
+	}
+	writeJSONResponse(w, map[string]bool{"open_annotations": request.OpenAnnotations})
+}
@@ -0,0 +1,153 @@
+package gameserver_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/vkryukov/gameserver"
+)
+
+func mustAnnotate(t *testing.T, gameID int, token gameserver.Token, annotation map[string]interface{}) *gameserver.Annotation {
+	annotation["token"] = token
+	resp := postObject(t, fmt.Sprintf("http://localhost:1234/game/%d/annotations", gameID), annotation)
+	var result gameserver.Annotation
+	if err := json.Unmarshal(resp, &result); err != nil || result.Id == 0 {
+		t.Fatalf("Failed to annotate game: %s", resp)
+	}
+	return &result
+}
+
+func TestAnnotations(t *testing.T) {
+	url := func(gameID int) string { return fmt.Sprintf("http://localhost:1234/game/%d/annotations", gameID) }
+
+	// Test 1: games in progress cannot be annotated
+	game := mustPlayGame(t, []string{"a", "b"}, "")
+	resp := postObject(t, url(game.Id), map[string]interface{}{"token": game.WhiteToken, "action_num": 1, "comment": "hmm"})
+	if !isErrorResponse(resp, "only finished games") {
+		t.Fatalf("Expected an error when annotating a game in progress, got %s", resp)
+	}
+
+	// Test 2: players annotate their games, others only if annotations are open
+	game = mustPlayGame(t, []string{"a", "b", "c", "d", "e"}, "Draw")
+	game, _ = gameserver.GetGameWithId(game.Id)
+	outsider := mustRegisterAndAuthenticateRandomUser(t)
+	resp = postObject(t, url(game.Id), map[string]interface{}{"token": outsider.Token, "action_num": 2, "comment": "nice"})
+	if !isErrorResponse(resp, "only the players") {
+		t.Fatalf("Expected an error when annotating someone else's game, got %s", resp)
+	}
+	comment := mustAnnotate(t, game.Id, game.WhiteToken, map[string]interface{}{"action_num": 2, "comment": "A strong reply", "symbol": "!"})
+	if comment.Author != game.WhitePlayer || comment.GameID != game.Id {
+		t.Fatalf("Unexpected annotation: %s", mustPrettyPrint(t, comment))
+	}
+	openURL := fmt.Sprintf("http://localhost:1234/game/%d/openannotations", game.Id)
+	resp = postObject(t, openURL, map[string]interface{}{"token": outsider.Token, "open_annotations": true})
+	if !isErrorResponse(resp, "only the players") {
+		t.Fatalf("Expected an error when opening annotations of someone else's game, got %s", resp)
+	}
+	resp = postObject(t, openURL, map[string]interface{}{"token": game.BlackToken, "open_annotations": true})
+	var opened struct {
+		OpenAnnotations bool `json:"open_annotations"`
+	}
+	if err := json.Unmarshal(resp, &opened); err != nil || !opened.OpenAnnotations {
+		t.Fatalf("Failed to open annotations: %s", resp)
+	}
+	variation := mustAnnotate(t, game.Id, outsider.Token, map[string]interface{}{"action_num": 3, "variation": []string{"x", "y"},
+		"comment": "Better"})
+	nested := mustAnnotate(t, game.Id, game.BlackToken, map[string]interface{}{"action_num": 4, "parent_id": variation.Id,
+		"variation": []string{"z"}, "symbol": "?!"})
+	if variation.Author != outsider.ScreenName || nested.Author != game.BlackPlayer {
+		t.Fatalf("Unexpected authors: %s, %s", variation.Author, nested.Author)
+	}
+	if strings.Join(variation.Players, " ") != "white black" || strings.Join(nested.Players, " ") != "black" {
+		t.Fatalf("Unexpected players: %v, %v", variation.Players, nested.Players)
+	}
+
+	// Test 3: annotations must refer to existing actions and have known symbols
+	for _, annotation := range []map[string]interface{}{
+		{"action_num": 6, "comment": "after the end"},
+		{"action_num": 5, "parent_id": variation.Id, "comment": "after the variation"},
+		{"action_num": 1, "symbol": "?!?"},
+		{"action_num": 1},
+	} {
+		annotation["token"] = game.WhiteToken
+		if resp := postObject(t, url(game.Id), annotation); !isErrorResponse(resp, "") {
+			t.Fatalf("Expected an error for annotation %v, got %s", annotation, resp)
+		}
+	}
+	var annotations []*gameserver.Annotation
+	httpResp, err := http.Get(url(game.Id))
+	if err != nil {
+		t.Fatalf("Failed to get annotations: %v", err)
+	}
+	defer httpResp.Body.Close()
+	if err := json.NewDecoder(httpResp.Body).Decode(&annotations); err != nil {
+		t.Fatalf("Failed to decode annotations: %v", err)
+	}
+	if len(annotations) != 3 || annotations[1].Variation[1] != "y" {
+		t.Fatalf("Unexpected annotations: %s", mustPrettyPrint(t, annotations))
+	}
+
+	// Test 4: annotations are exported, and skipped when importing
+	pgn, err := gameserver.ExportGame(game.Id, gameserver.FormatPGN)
+	if err != nil {
+		t.Fatalf("Failed to export game: %v", err)
+	}
+	expected := "1. a\n2... b\n$1\n{A strong reply}\n3. c\n(\n3. x\n{Better}\n4... y\n(\n4... z\n$6\n)\n)\n4... d\n5. e\n1/2-1/2\n"
+	if !strings.HasSuffix(pgn, expected) {
+		t.Fatalf("Unexpected PGN record:\n%s", pgn)
+	}
+	sgf, err := gameserver.ExportGame(game.Id, gameserver.FormatBoardspace)
+	if err != nil {
+		t.Fatalf("Failed to export game: %v", err)
+	}
+	expected = "; P0[1 a]\n; P1[2 b]TE[1]C[A strong reply]\n(\n; P0[3 c]\n; P1[4 d]\n; P0[5 e]\n)\n" +
+		"(\n; P0[3 x]C[Better]\n(\n; P1[4 y]\n)\n(\n; P1[4 z]DO[]\n)\n)\n)\n"
+	if !strings.HasSuffix(sgf, expected) {
+		t.Fatalf("Unexpected Boardspace record:\n%s", sgf)
+	}
+	for format, record := range map[gameserver.RecordFormat]string{gameserver.FormatPGN: pgn, gameserver.FormatBoardspace: sgf} {
+		imported := mustImportGame(t, record, format)
+		if imported.GameRecord != "a b c d e" {
+			t.Fatalf("Unexpected %s import: %q", format, imported.GameRecord)
+		}
+	}
+
+	// Test 5: variations are checked by the rules engine
+	imported := mustImportGame(t, "(;\nGM[Counting]\n; P0[1 1]\n; P1[2 2]\n; P0[3 3]\nRE[Draw]\n)\n", gameserver.FormatBoardspace)
+	err = gameserver.AddAnnotation(&gameserver.Annotation{GameID: imported.Id, ActionNum: 2, Variation: []string{"2", "3", "4"}})
+	if err != nil {
+		t.Fatalf("Failed to add a legal variation: %v", err)
+	}
+	err = gameserver.AddAnnotation(&gameserver.Annotation{GameID: imported.Id, ActionNum: 2, Variation: []string{"3"}})
+	if err == nil || !strings.Contains(err.Error(), "invalid variation") {
+		t.Fatalf("Expected an illegal variation to be rejected, got %v", err)
+	}
+
+	// Test 6: the players of variations come from the rules engine when it knows whose turn it is, and can be given
+	// otherwise
+	imported = mustImportGame(t, "(;\nGM[Connect6]\n; P0[1 a]\n; P1[2 b]\n; P1[3 c]\n; P0[4 d]\nRE[Draw]\n)\n",
+		gameserver.FormatBoardspace)
+	annotation := &gameserver.Annotation{GameID: imported.Id, ActionNum: 3, Variation: []string{"x", "y", "z"}, Players: []string{"white"}}
+	if err := gameserver.AddAnnotation(annotation); err != nil || strings.Join(annotation.Players, " ") != "black white white" {
+		t.Fatalf("Unexpected players of a variation: %v (%v)", annotation.Players, err)
+	}
+	given := mustAnnotate(t, game.Id, game.WhiteToken, map[string]interface{}{"action_num": 5, "variation": []string{"v", "w"},
+		"players": []string{"white", "white"}})
+	if strings.Join(given.Players, " ") != "white white" {
+		t.Fatalf("Unexpected players of a variation: %v", given.Players)
+	}
+	for _, players := range [][]string{{"white"}, {"white", "red"}} {
+		resp := postObject(t, url(game.Id), map[string]interface{}{"token": game.WhiteToken, "action_num": 5,
+			"variation": []string{"v", "w"}, "players": players})
+		if !isErrorResponse(resp, "") {
+			t.Fatalf("Expected an error for players %v, got %s", players, resp)
+		}
+	}
+	pgn, err = gameserver.ExportGame(game.Id, gameserver.FormatPGN)
+	if err != nil || !strings.Contains(pgn, "(\n5. v\n6. w\n)") {
+		t.Fatalf("Unexpected PGN record:\n%s (%v)", pgn, err)
+	}
+}
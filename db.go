@@ -31,7 +31,11 @@ func InitDB(path string) error {
 	if err != nil {
 		return err
 	}
+	return createSchema(db)
+}
 
+// createSchema creates the tables of a new database, and migrates those of an existing one to the latest schema.
+func createSchema(conn *sql.DB) error {
 	sqlStmt := `
 	CREATE TABLE IF NOT EXISTS users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -40,7 +44,9 @@ func InitDB(path string) error {
 		password_hash TEXT,
 		screen_name TEXT UNIQUE,
 		is_admin INTEGER DEFAULT 0,
-		creation_time REAL DEFAULT ((julianday('now') - 2440587.5)*86400000)
+		creation_time REAL DEFAULT ((julianday('now') - 2440587.5)*86400000),
+		-- the last time the user was connected to one of their games, or 0 if never
+		last_seen REAL DEFAULT 0
 	);
 
 	CREATE TABLE IF NOT EXISTS tokens (
@@ -66,7 +72,30 @@ func InitDB(path string) error {
 		viewer_token TEXT,
 		game_over INTEGER DEFAULT 0,
 		game_result TEXT DEFAULT "",
-		creation_time REAL DEFAULT ((julianday('now') - 2440587.5)*86400000)
+		creation_time REAL DEFAULT ((julianday('now') - 2440587.5)*86400000),
+		-- the id of the game created as a rematch of this one, or 0 if there is none
+		rematch_game_id INTEGER DEFAULT 0,
+		-- the base64-encoded Ed25519 public keys registered by the players, or '' if none
+		white_public_key TEXT DEFAULT '',
+		black_public_key TEXT DEFAULT '',
+		-- the chain hash of the last action when the game ended, its signature by the server's record key, and the
+		-- base64-encoded public key of that record key
+		record_head TEXT DEFAULT '',
+		record_signature TEXT DEFAULT '',
+		-- imported games were played elsewhere; white_name and black_name are the names of their players who are
+		-- not users of this server
+		imported INTEGER DEFAULT 0,
+		white_name TEXT DEFAULT '',
+		black_name TEXT DEFAULT '',
+		-- the game this one was forked from and the number of actions copied from it, or 0 if it was not forked
+		from_game_id INTEGER DEFAULT 0,
+		from_action_num INTEGER DEFAULT 0,
+		-- whether users other than the players can annotate the game
+		open_annotations INTEGER DEFAULT 0,
+		-- the last time each player was connected to this game, or 0 if never
+		white_last_seen REAL DEFAULT 0,
+		black_last_seen REAL DEFAULT 0,
+		record_key TEXT DEFAULT ''
 	);
 
 	CREATE TABLE IF NOT EXISTS actions (
@@ -74,14 +103,54 @@ func InitDB(path string) error {
 		-- the number of the action in the sequence (starting from 1)
 		action_num INTEGER,
 		action TEXT,
-		-- an MD5 hash of the (game_id, action_num, player_key, action), calculated by the client, for client integrity verification
+		-- the base64-encoded Ed25519 signature of ActionSigningData(game_id, action_num, action) by the player's key,
+		-- verified by the server if the player has registered a key
 		action_signature TEXT, 
+		-- the player who made the action ('white' or 'black')
+		player TEXT DEFAULT '',
+		-- the hex-encoded SHA-256 hash chaining the action to the previous one, see chainHash
+		chain_hash TEXT DEFAULT '',
 		creation_time REAL DEFAULT ((julianday('now') - 2440587.5)*86400000), 
+		-- an optional unique id chosen by the client, so that resubmitting the same action is harmless
+		client_action_id TEXT,
 		PRIMARY KEY (game_id, action_num)
 	);
+
+	CREATE TABLE IF NOT EXISTS annotations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		game_id INTEGER,
+		-- the annotated action, in the main line if parent_id is 0, or in the variation of the annotation parent_id
+		action_num INTEGER,
+		parent_id INTEGER DEFAULT 0,
+		-- the screen name of the author, or the color of a guest player
+		author TEXT,
+		comment TEXT DEFAULT '',
+		symbol TEXT DEFAULT '',
+		-- a JSON array of the actions played instead of the annotated action
+		variation TEXT DEFAULT '[]',
+		-- a JSON array of the players ('white' or 'black') who make the actions of the variation
+		variation_players TEXT DEFAULT '[]',
+		creation_time REAL DEFAULT ((julianday('now') - 2440587.5)*86400000)
+	);
+	CREATE INDEX IF NOT EXISTS annotations_game_id ON annotations(game_id);
+
+	CREATE TABLE IF NOT EXISTS openings (
+		game_type TEXT,
+		-- the hex-encoded SHA-256 hash of the actions played before the action, see openingKey
+		prefix TEXT,
+		action TEXT,
+		-- the number of games the action was played in, and their results
+		games INTEGER DEFAULT 0,
+		white_wins INTEGER DEFAULT 0,
+		draws INTEGER DEFAULT 0,
+		black_wins INTEGER DEFAULT 0,
+		PRIMARY KEY (game_type, prefix, action)
+	);
     `
-	_, err = db.Exec(sqlStmt)
-	return err
+	if _, err := conn.Exec(sqlStmt); err != nil {
+		return err
+	}
+	return migrate(conn)
 }
 
 func CloseDB() error {
@@ -162,19 +231,69 @@ func getUserIDFromScreenName(screenName string) (int, error) {
 }
 
 func markGameAsFinished(gameID int, result string) error {
-	_, err := db.Exec("UPDATE games SET game_over = 1, game_result = ? WHERE id = ?", result, gameID)
+	_, err := finishGame(gameID, func(tx *sql.Tx) (string, error) {
+		return result, nil
+	})
 	return err
 }
 
+// finishGame ends the game with the result returned by decide, and returns it. decide runs in the same transaction
+// as the update, once the transaction holds the write lock, so that nothing it checks can change before the game ends.
+// Games that are already over fail with ErrorGameOver.
+func finishGame(gameID int, decide func(tx *sql.Tx) (string, error)) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE games SET game_over = game_over WHERE id = ?", gameID); err != nil {
+		return "", err
+	}
+	// A game only ends once, so that its result cannot be changed afterwards, nor its record sealed again.
+	if err := checkGameStatusWith(tx, gameID); err != nil {
+		return "", err
+	}
+	if err := checkNotImported(tx, gameID); err != nil {
+		return "", err
+	}
+	result, err := decide(tx)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("UPDATE games SET game_over = 1, game_result = ? WHERE id = ?", result, gameID)
+	if err != nil {
+		return "", err
+	}
+	// Without a record key, games end without their records being sealed.
+	if key, err := getRecordKey(); err == nil {
+		if err := sealRecord(tx, key, gameID, result); err != nil {
+			return "", err
+		}
+	}
+	if err := indexResult(tx, gameID, result); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	forgetAbsentPlayers(gameID)
+	lobbyGameFinished(gameID, result)
+	return result, nil
+}
+
 // checkGameStatus checks the game's status and returns an error if the game is finished or other issues are found.
 func checkGameStatus(gameID int) error {
+	return checkGameStatusWith(db, gameID)
+}
+
+func checkGameStatusWith(q queryer, gameID int) error {
 	var gameOver int
-	err := db.QueryRow("SELECT game_over FROM games WHERE id = ?", gameID).Scan(&gameOver)
+	err := q.QueryRow("SELECT game_over FROM games WHERE id = ?", gameID).Scan(&gameOver)
 	if err != nil {
 		return err
 	}
 	if gameOver == 1 {
-		return fmt.Errorf("game is over")
+		return newCodedError(ErrorGameOver, "game is over")
 	}
 	return nil
 }
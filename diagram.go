@@ -0,0 +1,266 @@
+// diagram.go draws positions of games played on the hexagonal boards of the GIPF project as SVG diagrams, which can
+// be embedded in web pages and forums with the URL prefix/{id}/board.svg. The position is computed by the rules
+// engine of the game type, whose states must implement BoardState.
+
+package gameserver
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// BoardState is implemented by the game states of rules engines whose positions can be drawn.
+type BoardState interface {
+	GameState
+	// Board returns the board of the position.
+	Board() *Board
+}
+
+// Board is a hexagonal board whose points are arranged in columns "a", "b", ... from left to right, numbered from 1
+// at the bottom, such as the board of GIPF, whose 9 columns have from 5 to 9 points.
+type Board struct {
+	// Radius is the number of points from the center of the board to its edge, excluding the center: 4 for GIPF.
+	Radius int
+	// Pieces are the pieces on the board, by the name of their point, like "e5".
+	Pieces map[string]Piece
+}
+
+// Piece is a piece on a board.
+type Piece struct {
+	// Color is "white", "black", or any SVG color.
+	Color string
+	// Ring is true for pieces drawn as rings, such as the rings of YINSH.
+	Ring bool
+	// Height is the number of pieces stacked on the point, shown if it is more than 1.
+	Height int
+}
+
+// DiagramOptions are the options of a diagram.
+type DiagramOptions struct {
+	// Flipped draws the board from black's side.
+	Flipped bool
+	// Coordinates draws the names of the columns and rows.
+	Coordinates bool
+	// LastMove highlights these points.
+	LastMove []string
+}
+
+const (
+	diagramSpacing = 40.0 // the distance between neighboring points
+	diagramMargin  = 40.0
+)
+
+type boardPoint struct {
+	name   string
+	column int
+	row    int
+	edge   bool
+	x, y   float64
+}
+
+// points returns the points of the board with their coordinates in a diagram.
+func (board *Board) points(flipped bool) []boardPoint {
+	var points []boardPoint
+	size := 2*board.Radius + 1
+	width, height := board.diagramSize()
+	for column := 0; column < size; column++ {
+		offset := column - board.Radius
+		if offset < 0 {
+			offset = -offset
+		}
+		rows := size - offset
+		for row := 1; row <= rows; row++ {
+			point := boardPoint{
+				name:   fmt.Sprintf("%c%d", 'a'+column, row),
+				column: column,
+				row:    row,
+				edge:   column == 0 || column == size-1 || row == 1 || row == rows,
+				x:      diagramMargin + float64(column)*diagramSpacing*math.Sqrt(3)/2,
+				y:      height - diagramMargin - float64(row-1)*diagramSpacing - float64(offset)*diagramSpacing/2,
+			}
+			if flipped {
+				point.x, point.y = width-point.x, height-point.y
+			}
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+func (board *Board) diagramSize() (float64, float64) {
+	return 2*diagramMargin + float64(2*board.Radius)*diagramSpacing*math.Sqrt(3)/2,
+		2*diagramMargin + float64(2*board.Radius)*diagramSpacing
+}
+
+func svgColor(color string) string {
+	switch color {
+	case "white":
+		return "#fafafa"
+	case "black":
+		return "#222"
+	}
+	return html.EscapeString(color)
+}
+
+// DrawBoard returns the SVG diagram of the board.
+func DrawBoard(board *Board, options DiagramOptions) string {
+	width, height := board.diagramSize()
+	points := board.points(options.Flipped)
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" viewBox="0 0 %.0f %.0f">`+"\n",
+		width, height, width, height)
+	fmt.Fprintf(&svg, `<rect width="%.0f" height="%.0f" fill="#f2dfb4"/>`+"\n", width, height)
+
+	// The lines join neighboring points, except along the edge of the board.
+	svg.WriteString(`<g stroke="#5a4a32" stroke-width="1.5">` + "\n")
+	for i, p := range points {
+		for _, q := range points[i+1:] {
+			if (!p.edge || !q.edge) && math.Hypot(p.x-q.x, p.y-q.y) < diagramSpacing*1.01 {
+				fmt.Fprintf(&svg, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f"/>`+"\n", p.x, p.y, q.x, q.y)
+			}
+		}
+	}
+	svg.WriteString("</g>\n")
+	for _, p := range points {
+		if p.edge {
+			fmt.Fprintf(&svg, `<circle cx="%.1f" cy="%.1f" r="3" fill="#5a4a32"/>`+"\n", p.x, p.y)
+		}
+	}
+
+	if options.Coordinates {
+		svg.WriteString(`<g font-family="sans-serif" font-size="13" fill="#5a4a32" text-anchor="middle">` + "\n")
+		side := 1.0
+		if options.Flipped {
+			side = -1
+		}
+		for _, p := range points {
+			// Columns are named below their first point, and rows left of the first point of each row.
+			if p.row == 1 {
+				fmt.Fprintf(&svg, `<text x="%.1f" y="%.1f">%c</text>`+"\n", p.x, p.y+side*24+4, 'a'+p.column)
+			}
+			if p.column == 0 || p.row == p.column+board.Radius+1 {
+				fmt.Fprintf(&svg, `<text x="%.1f" y="%.1f">%d</text>`+"\n", p.x-side*20, p.y-side*8+4, p.row)
+			}
+		}
+		svg.WriteString("</g>\n")
+	}
+
+	lastMove := make(map[string]bool)
+	for _, name := range options.LastMove {
+		lastMove[name] = true
+	}
+	for _, p := range points {
+		if lastMove[p.name] {
+			fmt.Fprintf(&svg, `<circle class="last-move" cx="%.1f" cy="%.1f" r="%.1f" fill="#f7c948" fill-opacity="0.6"/>`+"\n",
+				p.x, p.y, diagramSpacing*0.48)
+		}
+	}
+	for _, p := range points {
+		piece, ok := board.Pieces[p.name]
+		if !ok {
+			continue
+		}
+		color := svgColor(piece.Color)
+		if piece.Ring {
+			fmt.Fprintf(&svg, `<circle cx="%.1f" cy="%.1f" r="%.1f" fill="none" stroke="%s" stroke-width="6"/>`+"\n",
+				p.x, p.y, diagramSpacing*0.36, color)
+		} else {
+			fmt.Fprintf(&svg, `<circle cx="%.1f" cy="%.1f" r="%.1f" fill="%s" stroke="#222" stroke-width="1.5"/>`+"\n",
+				p.x, p.y, diagramSpacing*0.4, color)
+		}
+		if piece.Height > 1 {
+			textColor := "#222"
+			if piece.Color == "black" {
+				textColor = "#fafafa"
+			}
+			fmt.Fprintf(&svg, `<text x="%.1f" y="%.1f" font-family="sans-serif" font-size="14" text-anchor="middle" `+
+				`fill="%s">%d</text>`+"\n", p.x, p.y+5, textColor, piece.Height)
+		}
+	}
+	svg.WriteString("</svg>\n")
+	return svg.String()
+}
+
+// changedPoints returns the points whose pieces differ between the boards.
+func changedPoints(before, after *Board) []string {
+	var changed []string
+	for name, piece := range after.Pieces {
+		if previous, ok := before.Pieces[name]; !ok || previous != piece {
+			changed = append(changed, name)
+		}
+	}
+	for name := range before.Pieces {
+		if _, ok := after.Pieces[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// GameDiagram returns the SVG diagram of the position of the game after the given number of actions. If lastMove
+// is true, the points changed by the last of these actions are highlighted.
+func GameDiagram(gameID, actionNum int, options DiagramOptions, lastMove bool) (string, error) {
+	state, err := GetPosition(gameID, actionNum)
+	if err != nil {
+		return "", err
+	}
+	boardState, ok := state.(BoardState)
+	if !ok {
+		return "", newCodedError(ErrorUnavailable, "positions of game %d cannot be drawn", gameID)
+	}
+	board := boardState.Board()
+	if lastMove && actionNum > 0 {
+		state, err := GetPosition(gameID, actionNum-1)
+		if err != nil {
+			return "", err
+		}
+		if previous, ok := state.(BoardState); ok {
+			options.LastMove = changedPoints(previous.Board(), board)
+		}
+	}
+	return DrawBoard(board, options), nil
+}
+
+// diagramHandler serves GET prefix/{id}/board.svg, which returns the diagram of the position after the number
+// of actions given by the "action" query parameter, or of the current position. The "orientation" parameter draws the
+// board from "white"'s side (the default) or "black"'s, and the "coordinates" and "lastmove" parameters, if "1" or
+// "true", draw the coordinates and highlight the last move. Private games require a token in the "token" parameter.
+func diagramHandler(w http.ResponseWriter, r *http.Request, gameID int) {
+	game, err := GetGameWithId(gameID)
+	if err != nil {
+		sendError(w, serverError("cannot find game", err))
+		return
+	}
+	if !canWatch(r, game) {
+		sendError(w, serverError("invalid token", nil))
+		return
+	}
+	actionNum, err := requestedActionNum(r, game)
+	if err != nil {
+		sendCodedError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	flag := func(name string) bool { return query.Get(name) == "1" || query.Get(name) == "true" }
+	options := DiagramOptions{Flipped: query.Get("orientation") == "black", Coordinates: flag("coordinates")}
+	diagram, err := GameDiagram(gameID, actionNum, options, flag("lastmove"))
+	if err != nil {
+		sendCodedError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	if query.Get("action") != "" {
+		// The position after a given action never changes.
+		visibility := "public"
+		if !game.Public {
+			visibility = "private"
+		}
+		w.Header().Set("Cache-Control", visibility+", max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Write([]byte(diagram))
+}
@@ -0,0 +1,100 @@
+package gameserver_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vkryukov/gameserver"
+)
+
+// placingRules is a rules engine for a game on a GIPF board where the players take turns placing a piece on an empty
+// point, named by the action.
+type placingRules struct{}
+
+type placingState map[string]gameserver.Piece
+
+func (placingRules) InitialState() gameserver.GameState {
+	return placingState{}
+}
+
+func (s placingState) Apply(action string) (gameserver.GameState, error) {
+	if _, ok := s[action]; ok {
+		return nil, fmt.Errorf("%s is not empty", action)
+	}
+	next := placingState{action: {Color: "white"}}
+	if len(s)%2 == 1 {
+		next[action] = gameserver.Piece{Color: "black"}
+	}
+	for point, piece := range s {
+		next[point] = piece
+	}
+	return next, nil
+}
+
+func (s placingState) Board() *gameserver.Board {
+	return &gameserver.Board{Radius: 4, Pieces: s}
+}
+
+func init() {
+	gameserver.RegisterRulesEngine("Placing", placingRules{})
+}
+
+func mustGetDiagram(t *testing.T, gameID int, query string) (*http.Response, string) {
+	resp, err := http.Get(fmt.Sprintf("http://localhost:1234/game/%d/board.svg?%s", gameID, query))
+	if err != nil {
+		t.Fatalf("Failed to get diagram: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read diagram: %v", err)
+	}
+	return resp, string(body)
+}
+
+func TestBoardDiagram(t *testing.T) {
+	game := mustImportGame(t, "(;\nGM[Placing]\n; P0[1 e5]\n; P1[2 b2]\n; P0[3 f6]\n)\n", gameserver.FormatBoardspace)
+	pieces := regexp.MustCompile(`<circle cx="([\d.]+)" cy="[\d.]+" r="16.0" fill="(#[0-9a-f]+)"`)
+
+	// Test 1: the diagram shows the position after the requested action
+	resp, svg := mustGetDiagram(t, game.Id, "action=2&coordinates=1&lastmove=1")
+	if resp.Header.Get("Content-Type") != "image/svg+xml" || !strings.Contains(resp.Header.Get("Cache-Control"), "immutable") {
+		t.Fatalf("Unexpected headers: %v", resp.Header)
+	}
+	if !strings.HasPrefix(svg, "<svg") || len(pieces.FindAllString(svg, -1)) != 2 {
+		t.Fatalf("Expected a diagram with 2 pieces, got:\n%s", svg)
+	}
+	if strings.Count(svg, `class="last-move"`) != 1 || !strings.Contains(svg, ">i</text>") || !strings.Contains(svg, ">9</text>") {
+		t.Fatalf("Expected the last move and coordinates to be drawn, got:\n%s", svg)
+	}
+	_, svg = mustGetDiagram(t, game.Id, "")
+	if len(pieces.FindAllString(svg, -1)) != 3 || strings.Contains(svg, "last-move") || strings.Contains(svg, "</text>") {
+		t.Fatalf("Expected the current position without options, got:\n%s", svg)
+	}
+
+	// Test 2: the board can be drawn from black's side
+	board := &gameserver.Board{Radius: 4, Pieces: map[string]gameserver.Piece{"b2": {Color: "black"}}}
+	center := func(options gameserver.DiagramOptions) float64 {
+		m := pieces.FindStringSubmatch(gameserver.DrawBoard(board, options))
+		x, _ := strconv.ParseFloat(m[1], 64)
+		return x
+	}
+	if white, black := center(gameserver.DiagramOptions{}), center(gameserver.DiagramOptions{Flipped: true}); white >= 180 || black <= 180 {
+		t.Fatalf("Expected b2 on the left from white's side and on the right from black's, got %v and %v", white, black)
+	}
+
+	// Test 3: only positions of rules engines with boards can be drawn
+	for _, id := range []int{
+		mustImportGame(t, "(;\nGM[Counting]\n; P0[1 1]\n)\n", gameserver.FormatBoardspace).Id,
+		mustPlayGame(t, []string{"a"}, "").Id,
+	} {
+		if _, body := mustGetDiagram(t, id, ""); !strings.Contains(body, string(gameserver.ErrorUnavailable)) {
+			t.Fatalf("Expected the diagram to be unavailable, got %s", body)
+		}
+	}
+}
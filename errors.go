@@ -0,0 +1,59 @@
+// errors.go defines the machine-readable error codes sent to clients along with the error text.
+
+package gameserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type ErrorCode string
+
+const (
+	ErrorInvalidMessage      ErrorCode = "invalid_message"
+	ErrorUnknownMessageType  ErrorCode = "unknown_message_type"
+	ErrorGameOver            ErrorCode = "game_over"
+	ErrorInvalidActionNumber ErrorCode = "invalid_action_number"
+	ErrorConflict            ErrorCode = "conflict"
+	ErrorInvalidSignature    ErrorCode = "invalid_signature"
+	ErrorNotAllowed          ErrorCode = "not_allowed"
+	ErrorUnavailable         ErrorCode = "unavailable"
+	ErrorInternal            ErrorCode = "internal_error"
+)
+
+// codedError is an error with a machine-readable code.
+type codedError struct {
+	code ErrorCode
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// newCodedError formats an error message like fmt.Errorf and attaches the code to it.
+func newCodedError(code ErrorCode, format string, args ...any) error {
+	return &codedError{code, fmt.Errorf(format, args...)}
+}
+
+// errorCode returns the code attached to the error, or ErrorInternal if there is none.
+func errorCode(err error) ErrorCode {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	return ErrorInternal
+}
+
+// sendCodedError sends the error to an HTTP client along with its code.
+func sendCodedError(w http.ResponseWriter, err error) {
+	writeJSONResponse(w, struct {
+		Error     string    `json:"error"`
+		ErrorCode ErrorCode `json:"error_code"`
+	}{err.Error(), errorCode(err)})
+}
@@ -0,0 +1,139 @@
+// events.go streams games to spectators as Server-Sent Events, so that watching a game needs neither a WebSocket
+// nor, for public games, a token. The stream starts with the actions made so far, followed by new actions and
+// the end of the game as they are broadcast.
+
+package gameserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// gameEventsHandler serves GET prefix/{id}/events. Private games require the viewer token (or a player's token)
+// in the "token" query parameter.
+func gameEventsHandler(w http.ResponseWriter, r *http.Request, gameID int) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	game, err := GetGameWithId(gameID)
+	if err != nil {
+		sendError(w, serverError("cannot find game", err))
+		return
+	}
+	if !canWatch(r, game) {
+		sendError(w, serverError("invalid token", nil))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, serverError("streaming is not supported", nil))
+		return
+	}
+
+	// Subscribe before reading the history, so that nothing made in between is missed.
+	conn := newStreamConn()
+	defer conn.Close()
+	addConnection(gameID, conn, Viewer)
+	defer removeConnection(conn)
+
+	actions, err := getAllActions(gameID)
+	if err != nil {
+		sendError(w, serverError("cannot get actions", err))
+		return
+	}
+	game, err = GetGameWithId(gameID)
+	if err != nil {
+		sendError(w, serverError("cannot find game", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	lastAction := 0
+	for _, action := range actions {
+		data, _ := json.Marshal(action)
+		if err := writeEvent(w, WebSocketMessage{GameID: gameID, Type: "Action", Message: string(data)}); err != nil {
+			return
+		}
+		lastAction = action.ActionNum
+	}
+	if game.GameOver {
+		writeEvent(w, WebSocketMessage{GameID: gameID, Type: "GameOver", Message: game.GameResult})
+		flusher.Flush()
+		return
+	}
+	flusher.Flush()
+
+	var ping <-chan time.Time
+	if conn.config.PingInterval > 0 {
+		ticker := time.NewTicker(conn.config.PingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	for {
+		select {
+		case message := <-conn.messages:
+			switch message.Type {
+			case "Action":
+				var action Action
+				if err := json.Unmarshal([]byte(message.Message), &action); err != nil || action.ActionNum <= lastAction {
+					// Already sent as part of the history.
+					continue
+				}
+				lastAction = action.ActionNum
+			case "GameOver":
+			default:
+				continue
+			}
+			if err := writeEvent(w, message); err != nil {
+				log.Printf("Error streaming events of game %d: %v", gameID, err)
+				return
+			}
+			flusher.Flush()
+			if message.Type == "GameOver" {
+				return
+			}
+		case <-ping:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-conn.closed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// canWatch reports whether the request may watch the game: public games can be watched by anyone, and private games
+// with a token of the game in the "token" query parameter.
+func canWatch(r *http.Request, game *Game) bool {
+	if game.Public {
+		return true
+	}
+	player, _ := validateGameToken(game.Id, Token(r.URL.Query().Get("token")))
+	return player != InvalidPlayer
+}
+
+// writeEvent writes the message as a Server-Sent Event named after the message type.
+func writeEvent(w io.Writer, message WebSocketMessage) error {
+	var event strings.Builder
+	if message.Seq > 0 {
+		fmt.Fprintf(&event, "id: %d\n", message.Seq)
+	}
+	fmt.Fprintf(&event, "event: %s\n", message.Type)
+	for _, line := range strings.Split(message.Message, "\n") {
+		fmt.Fprintf(&event, "data: %s\n", line)
+	}
+	event.WriteString("\n")
+	_, err := io.WriteString(w, event.String())
+	return err
+}
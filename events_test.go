@@ -0,0 +1,131 @@
+package gameserver_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vkryukov/gameserver"
+)
+
+type serverEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// mustReadEvent reads the next Server-Sent Event from the stream, skipping comments.
+func mustReadEvent(t *testing.T, reader *bufio.Reader) *serverEvent {
+	var event serverEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event.Event != "":
+			return &event
+		case strings.HasPrefix(line, "id: "):
+			event.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.Event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.Data += strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func mustGetEvents(t *testing.T, gameID int, token gameserver.Token) *http.Response {
+	resp, err := http.Get(fmt.Sprintf("http://localhost:1234/game/%d/events?token=%s", gameID, token))
+	if err != nil {
+		t.Fatalf("Failed to get events: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestGameEvents(t *testing.T) {
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user1, true, true)
+	mustJoinGame(t, user2, game)
+	conn := mustDialWS(t)
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, conn, "GameJoined")
+	makeAction := func(num int, move string) {
+		token := user1.Token
+		if num%2 == 0 {
+			token = user2.Token
+		}
+		data, _ := json.Marshal(&gameserver.Action{ActionNum: num, Action: move})
+		mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: token, Type: "Action", Message: string(data)})
+		mustReadWSMessageOfType(t, conn, "ActionAccepted")
+	}
+	makeAction(1, "a")
+
+	// Test 1: the stream of a public game starts with the history, and needs no token
+	resp := mustGetEvents(t, game.Id, "")
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", contentType)
+	}
+	reader := bufio.NewReader(resp.Body)
+	var action gameserver.Action
+	event := mustReadEvent(t, reader)
+	if err := json.Unmarshal([]byte(event.Data), &action); err != nil || event.Event != "Action" || action.Action != "a" {
+		t.Fatalf("Unexpected first event: %+v", event)
+	}
+
+	// Test 2: new actions are streamed as they are made
+	makeAction(2, "b")
+	event = mustReadEvent(t, reader)
+	if err := json.Unmarshal([]byte(event.Data), &action); err != nil || event.Event != "Action" || action.ActionNum != 2 || event.ID == "" {
+		t.Fatalf("Unexpected action event: %+v", event)
+	}
+
+	// Test 3: the stream ends with the end of the game
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "GameOver", Message: "Game won by white"})
+	if event = mustReadEvent(t, reader); event.Event != "GameOver" || event.Data != "Game won by white" {
+		t.Fatalf("Unexpected game over event: %+v", event)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(reader)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected the stream to end, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the stream to end")
+	}
+}
+
+func TestPrivateGameEvents(t *testing.T) {
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user1, true, false)
+	mustJoinGame(t, user2, game)
+
+	// Test 1: private games cannot be watched without the viewer token
+	body, _ := io.ReadAll(mustGetEvents(t, game.Id, "").Body)
+	if !isErrorResponse(body, "server: invalid token") {
+		t.Fatalf("Expected an invalid token error, got %s", body)
+	}
+
+	// Test 2: a finished game is streamed in full with the viewer token
+	if err := gameserver.ExecuteSQL("UPDATE games SET game_over = 1, game_result = 'Draw' WHERE id = ?", game.Id); err != nil {
+		t.Fatalf("Failed to finish the game: %v", err)
+	}
+	reader := bufio.NewReader(mustGetEvents(t, game.Id, game.ViewerToken).Body)
+	if event := mustReadEvent(t, reader); event.Event != "GameOver" || event.Data != "Draw" {
+		t.Fatalf("Unexpected event: %+v", event)
+	}
+}
@@ -0,0 +1,81 @@
+// fork.go implements derived games, which continue an existing game from one of its positions.
+
+package gameserver
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// checkForkSource checks that a game can be derived from the first fromAction actions of the game fromGame by the
+// players of the request. Private games can only be forked by their own players.
+func checkForkSource(request *Game) error {
+	source, err := GetGameWithId(request.FromGame)
+	if err != nil {
+		return fmt.Errorf("cannot find game %d to fork", request.FromGame)
+	}
+	if request.FromAction < 0 || request.FromAction > source.NumActions {
+		return newCodedError(ErrorInvalidActionNumber, "game %d has no action %d", source.Id, request.FromAction)
+	}
+	if source.Type != request.Type && request.Type != "" {
+		return fmt.Errorf("cannot fork a game of type %s as %s", source.Type, request.Type)
+	}
+	if !source.Public && !isPlayerOf(source, request.WhitePlayer) && !isPlayerOf(source, request.BlackPlayer) {
+		return newCodedError(ErrorNotAllowed, "only the players of a private game can fork it")
+	}
+	request.Type = source.Type
+	return nil
+}
+
+func isPlayerOf(game *Game, screenName string) bool {
+	return screenName != "" && (screenName == game.WhitePlayer || screenName == game.BlackPlayer)
+}
+
+// copyActions copies the first fromAction actions of the game fromGame to the game gameID and marks it as derived.
+// Signatures are bound to the game they were made in, so the copies are unsigned, and chained anew.
+func copyActions(tx *sql.Tx, fromGame, fromAction, gameID int) error {
+	_, err := tx.Exec("UPDATE games SET from_game_id = ?, from_action_num = ? WHERE id = ?", fromGame, fromAction, gameID)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query("SELECT action_num, action, player FROM actions WHERE game_id = ? AND action_num <= ? ORDER BY action_num",
+		fromGame, fromAction)
+	if err != nil {
+		return err
+	}
+	var actions []Action
+	var players []PlayerType
+	for rows.Next() {
+		var action Action
+		var player string
+		if err := rows.Scan(&action.ActionNum, &action.Action, &player); err != nil {
+			rows.Close()
+			return err
+		}
+		actions = append(actions, action)
+		switch player {
+		case WhitePlayer.String():
+			players = append(players, WhitePlayer)
+		case BlackPlayer.String():
+			players = append(players, BlackPlayer)
+		default:
+			// The players of actions made before players were recorded are unknown.
+			players = append(players, defaultPlayer(action.ActionNum))
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for i, action := range actions {
+		_, err := tx.Exec("INSERT INTO actions(game_id, action_num, action, action_signature, player) VALUES(?, ?, ?, '', ?)",
+			gameID, action.ActionNum, action.Action, players[i].String())
+		if err != nil {
+			return err
+		}
+		if err := chainAction(tx, gameID, players[i], action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package gameserver_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/vkryukov/gameserver"
+)
+
+func TestForkGame(t *testing.T) {
+	original := mustPlayGame(t, []string{"a", "b", "c", "d"}, "Draw")
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+
+	// Test 1: the fork starts with the prefix of the original's actions
+	resp := postObject(t, "http://localhost:1234/game/create", &gameserver.Game{
+		WhitePlayer: user1.ScreenName, WhiteToken: user1.Token, Public: true, FromGame: original.Id, FromAction: 2})
+	var fork gameserver.Game
+	if err := json.Unmarshal(resp, &fork); err != nil || fork.Id == 0 {
+		t.Fatalf("Failed to fork game: %s", resp)
+	}
+	if fork.Type != "Gipf" || fork.FromGame != original.Id || fork.FromAction != 2 || fork.GameRecord != "a b" ||
+		fork.GameOver {
+		t.Fatalf("Unexpected fork: %s", mustPrettyPrint(t, fork))
+	}
+
+	// Test 2: the fork continues independently of the original, which is untouched
+	mustJoinGame(t, user2, &fork)
+	url := fmt.Sprintf("http://localhost:1234/game/%d/actions", fork.Id)
+	resp = postObject(t, url, map[string]interface{}{"token": user1.Token, "action_num": 3, "action": "x"})
+	if isErrorResponse(resp, "") {
+		t.Fatalf("Failed to continue the fork: %s", resp)
+	}
+	fork2, err := gameserver.GetGameWithId(fork.Id)
+	if err != nil || fork2.GameRecord != "a b x" {
+		t.Fatalf("Unexpected fork record: %v, %v", fork2, err)
+	}
+	original, err = gameserver.GetGameWithId(original.Id)
+	if err != nil || original.GameRecord != "a b c d" || !original.GameOver {
+		t.Fatalf("The original game has changed: %v, %v", original, err)
+	}
+	recordKey, err := gameserver.RecordPublicKey()
+	if err != nil {
+		t.Fatalf("Failed to get the record key: %v", err)
+	}
+	if err := gameserver.VerifyRecord(mustExportRecord(t, original.Id), recordKey); err != nil {
+		t.Fatalf("The original record no longer verifies: %v", err)
+	}
+
+	// Test 3: the prefix must exist
+	_, err = gameserver.CreateGame(&gameserver.Game{
+		WhitePlayer: user1.ScreenName, WhiteToken: user1.Token, FromGame: original.Id, FromAction: 5})
+	if err == nil {
+		t.Fatalf("Expected an error when forking past the end of the game")
+	}
+
+	// Test 4: private games can only be forked by their players
+	private := mustCreateGame(t, user1, true, false)
+	_, err = gameserver.CreateGame(&gameserver.Game{
+		BlackPlayer: user2.ScreenName, BlackToken: user2.Token, FromGame: private.Id})
+	if err == nil {
+		t.Fatalf("Expected an error when forking someone else's private game")
+	}
+	fork3, err := gameserver.CreateGame(&gameserver.Game{
+		BlackPlayer: user1.ScreenName, BlackToken: user1.Token, FromGame: private.Id})
+	if err != nil || fork3.FromGame != private.Id || fork3.NumActions != 0 {
+		t.Fatalf("Failed to fork own private game: %v, %v", fork3, err)
+	}
+}
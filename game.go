@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -16,6 +17,53 @@ func RegisterGameHandlers(prefix string) {
 	http.HandleFunc(prefix+"/list/joinable", Middleware(joinableGamesHandler))
 	http.HandleFunc(prefix+"/join", Middleware(joinGameHandler))
 	http.HandleFunc(prefix+"/cancel", Middleware(cancelGameHandler))
+	http.HandleFunc(prefix+"/rematch", Middleware(rematchGameHandler))
+	http.HandleFunc(prefix+"/presence", Middleware(presenceHandler))
+	http.HandleFunc(prefix+"/recordkey", Middleware(recordKeyHandler))
+	http.HandleFunc(prefix+"/export/byuser", EnableCors(exportUserGamesHandler))
+	http.HandleFunc(prefix+"/import", Middleware(importGameHandler))
+	http.HandleFunc(prefix+"/openings", Middleware(openingsHandler))
+	http.HandleFunc(prefix+"/", EnableCors(gameResourceHandler(prefix)))
+}
+
+// gameResources are the handlers of the routes of the form prefix/{id}/{resource}.
+var gameResources = map[string]func(w http.ResponseWriter, r *http.Request, gameID int){
+	"events":          gameEventsHandler,
+	"actions":         gameActionsHandler,
+	"verify":          verifyGameHandler,
+	"record":          recordHandler,
+	"export":          exportGameHandler,
+	"position":        positionHandler,
+	"annotations":     annotationsHandler,
+	"openannotations": openAnnotationsHandler,
+	"board.svg":       diagramHandler,
+	"animation.gif":   animationHandler,
+}
+
+// streamingGameResources are the game resources that stream their responses, and so are not logged.
+var streamingGameResources = map[string]bool{"events": true}
+
+// gameResourceHandler serves the game resources, with the same middleware as the other endpoints.
+func gameResourceHandler(prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, prefix+"/"), "/")
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		gameID, err := strconv.Atoi(parts[0])
+		handler := gameResources[parts[1]]
+		if err != nil || handler == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if streamingGameResources[parts[1]] {
+			// The response writer of the logging middleware cannot flush, which streams need.
+			handler(w, r, gameID)
+			return
+		}
+		loggingMiddleware(func(w http.ResponseWriter, r *http.Request) { handler(w, r, gameID) })(w, r)
+	}
 }
 
 // Game
@@ -34,13 +82,25 @@ type Game struct {
 	NumActions   int    `json:"num_actions"`
 	GameRecord   string `json:"game_record"`
 	Public       bool   `json:"public"`
+	// WhitePublicKey and BlackPublicKey are the Ed25519 keys the players sign their actions with, if registered.
+	WhitePublicKey string `json:"white_public_key,omitempty"`
+	BlackPublicKey string `json:"black_public_key,omitempty"`
+	// Imported is true for games played elsewhere and imported from their records.
+	Imported bool `json:"imported,omitempty"`
+	// FromGame and FromAction are set for games forked from the first FromAction actions of the game FromGame.
+	FromGame   int `json:"from_game,omitempty"`
+	FromAction int `json:"from_action,omitempty"`
+	// OpenAnnotations allows users other than the players to annotate the game once it is finished.
+	OpenAnnotations bool `json:"open_annotations,omitempty"`
 }
 
 func GetGameWithId(id int) (*Game, error) {
 	query := `
 		SELECT 
 			g.id, g.type, u1.screen_name, u2.screen_name, g.white_token, g.black_token, 
-			g.viewer_token, g.game_over, g.game_result, g.creation_time
+			g.viewer_token, g.game_over, g.game_result, g.creation_time, g.white_public_key, g.black_public_key,
+			g.imported, g.white_name, g.black_name, g.from_game_id, g.from_action_num,
+			g.open_annotations
 		FROM games g
 		LEFT JOIN users u1 ON g.white_user_id = u1.id
 		LEFT JOIN users u2 ON g.black_user_id = u2.id
@@ -52,7 +112,9 @@ func GetGameWithId(id int) (*Game, error) {
 	var creationTime float64
 
 	err := db.QueryRow(query, id).Scan(&game.Id, &game.Type, &whiteUser, &blackUser, &game.WhiteToken, &game.BlackToken, &game.ViewerToken,
-		&game.GameOver, &game.GameResult, &creationTime)
+		&game.GameOver, &game.GameResult, &creationTime, &game.WhitePublicKey, &game.BlackPublicKey,
+		&game.Imported, &game.WhitePlayer, &game.BlackPlayer, &game.FromGame, &game.FromAction,
+		&game.OpenAnnotations)
 	if err != nil {
 		return nil, err
 	}
@@ -61,6 +123,7 @@ func GetGameWithId(id int) (*Game, error) {
 		game.Public = true
 	}
 
+	// Players who are users take precedence over the names of imported players.
 	if whiteUser.Valid {
 		game.WhitePlayer = whiteUser.String
 	}
@@ -99,8 +162,6 @@ func GetGameRecord(gameID int) (string, int, error) {
 }
 
 func CreateGame(request *Game) (*Game, error) {
-	var whiteToken, blackToken, viewerToken Token
-
 	if request.WhitePlayer != "" {
 		_, err := getUserIDFromScreenName(request.WhitePlayer)
 		if err != nil {
@@ -124,11 +185,19 @@ func CreateGame(request *Game) (*Game, error) {
 	if request.WhitePlayer == request.BlackPlayer {
 		return nil, fmt.Errorf("white and black players cannot be the same")
 	}
-
-	whiteToken = GenerateToken()
-	blackToken = GenerateToken()
-	if !request.Public {
-		viewerToken = GenerateToken()
+	if err := checkPublicKey(request.WhitePublicKey); err != nil {
+		return nil, err
+	}
+	if err := checkPublicKey(request.BlackPublicKey); err != nil {
+		return nil, err
+	}
+	if (request.WhitePlayer == "" && request.WhitePublicKey != "") || (request.BlackPlayer == "" && request.BlackPublicKey != "") {
+		return nil, fmt.Errorf("public keys can only be registered for taken seats")
+	}
+	if request.FromGame != 0 {
+		if err := checkForkSource(request); err != nil {
+			return nil, err
+		}
 	}
 
 	var whiteUserID, blackUserID int
@@ -150,19 +219,69 @@ func CreateGame(request *Game) (*Game, error) {
 		}
 	}
 
-	res, err := db.Exec(`
-		INSERT INTO games(type, white_user_id, black_user_id, white_token, black_token, viewer_token) 
-		VALUES(?, ?, ?, ?, ?, ?)
-	`, request.Type, whiteUserID, blackUserID, whiteToken, blackToken, viewerToken)
+	tx, err := db.Begin()
 	if err != nil {
 		return nil, err
 	}
-	gameID, err := res.LastInsertId()
+	defer tx.Rollback()
+	gameID, err := insertGame(tx, request.Type, whiteUserID, blackUserID, request.Public)
+	if err != nil {
+		return nil, err
+	}
+	if request.OpenAnnotations {
+		if _, err := tx.Exec("UPDATE games SET open_annotations = 1 WHERE id = ?", gameID); err != nil {
+			return nil, err
+		}
+	}
+	if request.FromGame != 0 {
+		if err := copyActions(tx, request.FromGame, request.FromAction, gameID); err != nil {
+			return nil, err
+		}
+	}
+	if request.WhitePublicKey != "" {
+		if err := registerPublicKey(tx, gameID, WhitePlayer, request.WhitePublicKey); err != nil {
+			return nil, err
+		}
+	}
+	if request.BlackPublicKey != "" {
+		if err := registerPublicKey(tx, gameID, BlackPlayer, request.BlackPublicKey); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	game, err := GetGameWithId(gameID)
 	if err != nil {
 		return nil, err
 	}
+	lobbyGameCreated(game)
+	return game, nil
+}
 
-	return GetGameWithId(int(gameID))
+// insertGame adds a new game with freshly generated tokens to the database and returns its id.
+// A user id of -1 means that the corresponding seat is still open.
+func insertGame(exec execer, gameType string, whiteUserID, blackUserID int, public bool) (int, error) {
+	whiteToken := GenerateToken()
+	blackToken := GenerateToken()
+	var viewerToken Token
+	if !public {
+		viewerToken = GenerateToken()
+	}
+
+	res, err := exec.Exec(`
+		INSERT INTO games(type, white_user_id, black_user_id, white_token, black_token, viewer_token) 
+		VALUES(?, ?, ?, ?, ?, ?)
+	`, gameType, whiteUserID, blackUserID, whiteToken, blackToken, viewerToken)
+	if err != nil {
+		return 0, err
+	}
+	gameID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(gameID), nil
 }
 
 func tokenMismatchUser(screenName string, token Token) bool {
@@ -294,6 +413,8 @@ func joinableGamesByUser(user *User) ([]*Game, error) {
 			AND
 			g.viewer_token = ''
 			AND
+			g.imported = 0
+			AND
 			(g.white_user_id != ? AND g.black_user_id != ?)
 		GROUP BY g.id
 	`
@@ -341,12 +462,18 @@ func joinGameHandler(w http.ResponseWriter, r *http.Request) {
 	var request struct {
 		Id    int   `json:"id"`
 		Token Token `json:"token"`
+		// PublicKey is the optional Ed25519 key the player will sign their actions with.
+		PublicKey string `json:"public_key"`
 	}
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
 		sendError(w, serverError("incorrect request", err))
 		return
 	}
+	if err := checkPublicKey(request.PublicKey); err != nil {
+		sendError(w, err)
+		return
+	}
 
 	// check that the game exists and is joinable
 	game, err := GetGameWithId(request.Id)
@@ -367,29 +494,52 @@ func joinGameHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	token := GenerateToken()
+	seat := BlackPlayer
+	if game.WhitePlayer == "" {
+		seat = WhitePlayer
+	}
 
-	// update the game
-	err = updateGame(game, user.Id, token)
+	// update the game, registering the public key along with the seat
+	tx, err := db.Begin()
+	if err != nil {
+		sendError(w, serverError("cannot update game", err))
+		return
+	}
+	defer tx.Rollback()
+	err = updateGame(tx, game, user.Id, token)
 	if err != nil {
 		sendError(w, serverError("cannot update game", err))
 		return
 	}
+	if request.PublicKey != "" {
+		if err := registerPublicKey(tx, game.Id, seat, request.PublicKey); err != nil {
+			sendError(w, serverError("cannot register the public key", err))
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		sendError(w, serverError("cannot update game", err))
+		return
+	}
 
 	// clear the other player token
-	if game.WhitePlayer == "" {
+	if seat == WhitePlayer {
 		game.BlackToken = ""
 		game.WhitePlayer = user.ScreenName
 		game.WhiteToken = token
+		game.WhitePublicKey = request.PublicKey
 	} else {
 		game.WhiteToken = ""
 		game.BlackPlayer = user.ScreenName
 		game.BlackToken = token
+		game.BlackPublicKey = request.PublicKey
 	}
+	lobbySeekJoined(game)
 
 	writeJSONResponse(w, game)
 }
 
-func updateGame(game *Game, userId int, token Token) error {
+func updateGame(exec execer, game *Game, userId int, token Token) error {
 	var query string
 	if game.WhitePlayer == "" {
 		query = "UPDATE games SET white_user_id = ?, white_token = ? WHERE id = ?"
@@ -398,7 +548,7 @@ func updateGame(game *Game, userId int, token Token) error {
 	} else {
 		return fmt.Errorf("game is full: %v", game)
 	}
-	_, err := db.Exec(query, userId, token, game.Id)
+	_, err := exec.Exec(query, userId, token, game.Id)
 	return err
 }
 
@@ -431,5 +581,7 @@ func cancelGameHandler(w http.ResponseWriter, r *http.Request) {
 		sendError(w, serverError("cannot delete game", err))
 		return
 	}
+	forgetSnapshots(request.Id)
+	lobbySeekCancelled(game)
 	writeJSONResponse(w, map[string]interface{}{"status": "game deleted successfully", "id": request.Id})
 }
@@ -445,3 +445,65 @@ func TestCancelGame(t *testing.T) {
 		t.Fatalf("Expected error when canceling a game that has started, got %s", resp)
 	}
 }
+
+func TestRematch(t *testing.T) {
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user1, true, false)
+	mustJoinGame(t, user2, game)
+
+	rematch := func(user *gameserver.User) []byte {
+		return postObject(t, "http://localhost:1234/game/rematch", map[string]interface{}{
+			"id":    game.Id,
+			"token": user.Token,
+		})
+	}
+
+	// Test 1: cannot rematch a game that is still in progress
+	resp := rematch(user1)
+	if !isErrorResponse(resp, "not over") {
+		t.Fatalf("Expected error when rematching a game in progress, got %s", resp)
+	}
+
+	// Test 2: the first request only records the offer
+	err := gameserver.ExecuteSQL("UPDATE games SET game_over = 1, game_result = '1-0' WHERE id = ?", game.Id)
+	if err != nil {
+		t.Fatalf("Failed to finish the game: %v", err)
+	}
+	resp = rematch(user1)
+	if isErrorResponse(resp, "") {
+		t.Fatalf("Cannot offer a rematch: %s", resp)
+	}
+	var offer struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(resp, &offer); err != nil || offer.Status != "rematch offered" {
+		t.Fatalf("Expected a rematch offer, got %s", resp)
+	}
+
+	// Test 3: once the opponent agrees, a new game with swapped colors is created
+	var newGame gameserver.Game
+	resp = rematch(user2)
+	if err := json.Unmarshal(resp, &newGame); err != nil || newGame.Id == 0 {
+		t.Fatalf("Expected a new game, got %s", resp)
+	}
+	if newGame.Id == game.Id || newGame.Type != game.Type || newGame.Public {
+		t.Fatalf("Rematch game has wrong settings: %s", mustPrettyPrint(t, newGame))
+	}
+	if newGame.WhitePlayer != user2.ScreenName || newGame.BlackPlayer != user1.ScreenName {
+		t.Fatalf("Expected swapped colors, got white %q and black %q", newGame.WhitePlayer, newGame.BlackPlayer)
+	}
+	if newGame.WhiteToken == "" || newGame.BlackToken != "" {
+		t.Fatalf("Expected only the requester's token, got %q/%q", newGame.WhiteToken, newGame.BlackToken)
+	}
+
+	// Test 4: asking again returns the same rematch game
+	var sameGame gameserver.Game
+	mustDecodeRequestWithObject(t, "http://localhost:1234/game/rematch", map[string]interface{}{
+		"id":    game.Id,
+		"token": user1.Token,
+	}, &sameGame)
+	if sameGame.Id != newGame.Id || sameGame.BlackToken == "" || sameGame.WhiteToken != "" {
+		t.Fatalf("Expected the existing rematch game with black token, got %s", mustPrettyPrint(t, sameGame))
+	}
+}
@@ -3,14 +3,16 @@ module github.com/vkryukov/gameserver
 go 1.21.5
 
 require (
+	github.com/google/uuid v1.5.0
 	github.com/gorilla/websocket v1.5.1
 	github.com/mattn/go-sqlite3 v1.14.19
+	github.com/vmihailenco/msgpack/v5 v5.4.1
 	golang.org/x/crypto v0.16.0
 	gopkg.in/mail.v2 v2.3.1
 )
 
 require (
-	github.com/google/uuid v1.5.0 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 	golang.org/x/net v0.17.0 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 )
@@ -0,0 +1,269 @@
+// hub.go implements the per-game hubs. Each game with connected clients has its own hub goroutine, which owns the
+// set of connections subscribed to the game and the game's broadcast stream. All access to them goes through
+// the hub, so games never contend with each other. A hub shuts itself down once it has had no connections and
+// no activity for a while, and is started again on demand.
+
+package gameserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// gameConnection is a connection to a game together with the role of whoever joined the game through it.
+type gameConnection struct {
+	Conn
+	player PlayerType
+	// lastAction is the last action the connection received when it joined; broadcasts of actions up to it are
+	// not sent to it again.
+	lastAction int
+}
+
+type gameHub struct {
+	gameID   int
+	requests chan func()
+	stopped  chan struct{}
+
+	// The fields below are only accessed from the hub goroutine.
+	conns  []gameConnection
+	stream gameStream
+	// idleTimeout is the HubIdleTimeout of the configuration of the connection that joined the game last.
+	idleTimeout time.Duration
+	idle        *time.Timer
+	// lastActive is the last time a connection joined or left the game, or a message was broadcast to it.
+	lastActive time.Time
+}
+
+// maxRetiredSeqs is the number of games whose last sequence number is remembered after their hubs have shut down.
+const maxRetiredSeqs = 4096
+
+var (
+	hubs   = make(map[int]*gameHub)
+	hubsMu sync.Mutex
+	// retiredSeqs remembers the last sequence number of games whose hubs have shut down, so that sequence
+	// numbers keep increasing when the hub is started again. When it grows too large, it is forgotten, and
+	// retiredSeqFloor, the largest sequence number it held, is used for all games instead.
+	retiredSeqs     = make(map[int]int)
+	retiredSeqFloor int
+)
+
+// retiredSeq returns the sequence number a new hub of the game starts from. The caller must hold hubsMu.
+func retiredSeq(gameID int) int {
+	if seq, ok := retiredSeqs[gameID]; ok {
+		return seq
+	}
+	return retiredSeqFloor
+}
+
+// retire remembers the last sequence number of a game whose hub is shutting down. The caller must hold hubsMu.
+func retire(gameID int, seq int) {
+	if len(retiredSeqs) >= maxRetiredSeqs {
+		for _, retired := range retiredSeqs {
+			retiredSeqFloor = max(retiredSeqFloor, retired)
+		}
+		retiredSeqs = make(map[int]int)
+	}
+	if seq > retiredSeqFloor {
+		retiredSeqs[gameID] = seq
+	}
+}
+
+// getHub returns the running hub of the game, starting a new one if create is true. It returns nil if there is
+// no running hub and create is false.
+func getHub(gameID int, create bool) *gameHub {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
+
+	hub := hubs[gameID]
+	if hub == nil && create {
+		hub = &gameHub{
+			gameID:      gameID,
+			requests:    make(chan func()),
+			stopped:     make(chan struct{}),
+			stream:      gameStream{seq: retiredSeq(gameID)},
+			idleTimeout: getWebSocketConfig().HubIdleTimeout,
+			lastActive:  time.Now(),
+		}
+		delete(retiredSeqs, gameID)
+		hubs[gameID] = hub
+		go hub.run()
+	}
+	return hub
+}
+
+func (h *gameHub) run() {
+	h.idle = time.NewTimer(h.idleTimeout)
+	defer h.idle.Stop()
+	for {
+		select {
+		case request := <-h.requests:
+			request()
+		case <-h.idle.C:
+			if len(h.conns) > 0 {
+				h.idle.Reset(h.idleTimeout)
+				continue
+			}
+			if remaining := h.idleTimeout - time.Since(h.lastActive); remaining > 0 {
+				h.idle.Reset(remaining)
+				continue
+			}
+			hubsMu.Lock()
+			delete(hubs, h.gameID)
+			retire(h.gameID, h.stream.seq)
+			close(h.stopped)
+			hubsMu.Unlock()
+			return
+		}
+	}
+}
+
+// withHub runs f in the hub goroutine of the game and waits for it to finish. If create is false and the game
+// has no running hub, f is not run and withHub returns false.
+func withHub(gameID int, create bool, f func(h *gameHub)) bool {
+	for {
+		hub := getHub(gameID, create)
+		if hub == nil {
+			return false
+		}
+		done := make(chan struct{})
+		select {
+		case hub.requests <- func() { f(hub); close(done) }:
+			<-done
+			return true
+		case <-hub.stopped:
+			// The hub has just shut down; try again with a new one.
+		}
+	}
+}
+
+// addConnection registers the connection as belonging to the given player of the game. It returns true if the player
+// had no other connections to the game before.
+func addConnection(gameID int, conn Conn, player PlayerType) bool {
+	isNew := true
+	withHub(gameID, true, func(h *gameHub) {
+		isNew = h.add(conn, player)
+	})
+	conn.joinedGame(gameID)
+	return isNew
+}
+
+// add registers the connection with the hub, like addConnection.
+func (h *gameHub) add(conn Conn, player PlayerType) bool {
+	isNew := true
+	found := false
+	for i, c := range h.conns {
+		if c.Conn == conn {
+			h.conns[i].player = player
+			found = true
+		} else if c.player == player {
+			isNew = false
+		}
+	}
+	if !found {
+		h.conns = append(h.conns, gameConnection{Conn: conn, player: player})
+	}
+	if h.idleTimeout != conn.config.HubIdleTimeout {
+		h.idleTimeout = conn.config.HubIdleTimeout
+		h.idle.Reset(h.idleTimeout)
+	}
+	h.lastActive = time.Now()
+	return isNew
+}
+
+// skipActionsUpTo stops broadcasts of the actions up to actionNum from being sent to the connection.
+func (h *gameHub) skipActionsUpTo(conn Conn, actionNum int) {
+	for i, c := range h.conns {
+		if c.Conn == conn {
+			h.conns[i].lastAction = actionNum
+		}
+	}
+}
+
+// unregisterConnection removes the connection from the game. It returns the player the connection belonged to,
+// and whether that player still has other connections to the game.
+func unregisterConnection(gameID int, conn Conn) (player PlayerType, stillConnected bool) {
+	player = InvalidPlayer
+	withHub(gameID, false, func(h *gameHub) {
+		var remaining []gameConnection
+		for _, c := range h.conns {
+			if c.Conn == conn {
+				player = c.player
+			} else {
+				remaining = append(remaining, c)
+			}
+		}
+		h.conns = remaining
+		h.lastActive = time.Now()
+		for _, c := range remaining {
+			stillConnected = stillConnected || c.player == player
+		}
+	})
+	return player, stillConnected
+}
+
+func broadcast(gameID int, action WebSocketMessage) {
+	broadcastExcept(gameID, Conn{}, action)
+}
+
+// broadcastExcept sends the message to all connections to the game other than the given one. Connections that
+// cannot keep up are closed by Send, and unregister themselves once their reader goroutine notices.
+func broadcastExcept(gameID int, except Conn, action WebSocketMessage) {
+	actionNum := broadcastActionNum(action)
+	withHub(gameID, true, func(h *gameHub) {
+		action = h.stream.record(action)
+		h.lastActive = time.Now()
+		for _, conn := range h.conns {
+			if conn.Conn == except || (actionNum > 0 && actionNum <= conn.lastAction) {
+				continue
+			}
+			if err := conn.Send(action); err != nil {
+				log.Printf("Failed to send action to conn %s: %v", conn, err)
+			}
+		}
+	})
+}
+
+// broadcastActionNum returns the number of the action broadcast by the message, or 0 if it is not an action.
+func broadcastActionNum(message WebSocketMessage) int {
+	if message.Type != "Action" {
+		return 0
+	}
+	var action Action
+	if err := json.Unmarshal([]byte(message.Message), &action); err != nil {
+		return 0
+	}
+	return action.ActionNum
+}
+
+// ConnectionStats describes the hubs that are currently running, for monitoring.
+type ConnectionStats struct {
+	Hubs        int         `json:"hubs"`
+	Connections int         `json:"connections"`
+	Games       map[int]int `json:"games"`
+}
+
+func GetConnectionStats() ConnectionStats {
+	hubsMu.Lock()
+	gameIDs := make([]int, 0, len(hubs))
+	for gameID := range hubs {
+		gameIDs = append(gameIDs, gameID)
+	}
+	hubsMu.Unlock()
+
+	stats := ConnectionStats{Games: make(map[int]int)}
+	for _, gameID := range gameIDs {
+		withHub(gameID, false, func(h *gameHub) {
+			stats.Hubs++
+			stats.Connections += len(h.conns)
+			stats.Games[gameID] = len(h.conns)
+		})
+	}
+	return stats
+}
+
+func handleConnectionStats(w http.ResponseWriter, r *http.Request) {
+	writeJSONResponse(w, GetConnectionStats())
+}
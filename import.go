@@ -0,0 +1,369 @@
+// import.go imports games played elsewhere from their records, in the formats produced by notation.go. Imported
+// games are public, cannot be joined, and cannot go on: no action can be added to them, nor can they be finished. Their players are matched to users by screen name when possible,
+// and their actions are checked with the rules engine of the game type if one is registered.
+
+package gameserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type importedAction struct {
+	Player PlayerType
+	Action string
+}
+
+// parsedRecord is a game record read from a file.
+type parsedRecord struct {
+	Type         string
+	White, Black string
+	GameOver     bool
+	Result       string
+	Date         time.Time
+	Actions      []importedAction
+}
+
+var (
+	pgnHeader = regexp.MustCompile(`^\[(\w+)\s+"((?:\\.|[^"\\])*)"\]$`)
+	// pgnActionLine is a line of the "actions" notation written by formatPGN.
+	pgnActionLine = regexp.MustCompile(`^(\d+)(\.\.\.|\.)\s+(.+)$`)
+	pgnMoveNumber = regexp.MustCompile(`^\d+\.+`)
+	pgnComment    = regexp.MustCompile(`\{[^}]*\}`)
+	pgnEscape     = regexp.MustCompile(`\\(.)`)
+
+	sgfProperty      = regexp.MustCompile(`([A-Z][A-Z0-9]*)\[((?:\\.|[^\]\\])*)\]`)
+	boardspaceAction = regexp.MustCompile(`^(\d+)\s+(.+)$`)
+)
+
+func isPGNResult(token string) bool {
+	return token == "1-0" || token == "0-1" || token == "1/2-1/2" || token == "*"
+}
+
+// parsePGN reads a PGN-like record. Records written by formatPGN have one action per line; other records are
+// read as standard PGN, where the actions are separated by spaces and alternate between white and black.
+func parsePGN(text string) (*parsedRecord, error) {
+	headers := make(map[string]string)
+	var body []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if m := pgnHeader.FindStringSubmatch(line); m != nil {
+			headers[m[1]] = pgnEscape.ReplaceAllString(m[2], "$1")
+		} else if line != "" && !strings.HasPrefix(line, "%") {
+			body = append(body, line)
+		}
+	}
+
+	record := &parsedRecord{Type: headers["GameType"], White: headers["White"], Black: headers["Black"]}
+	record.Date, _ = time.Parse("2006.01.02", headers["Date"])
+	switch headers["Result"] {
+	case "1-0":
+		record.GameOver, record.Result = true, "Game won by white"
+	case "0-1":
+		record.GameOver, record.Result = true, "Game won by black"
+	case "1/2-1/2":
+		record.GameOver, record.Result = true, "Draw"
+	}
+	// Termination describes how the game ended, like the results written by formatPGN, which can be more precise
+	// than Result. It is only used when it agrees with Result, or for games that ended without a winner or a draw.
+	if termination := headers["Termination"]; termination != "" {
+		token := resultToken(&Game{GameOver: true, GameResult: termination})
+		if (token == "*" && !record.GameOver) || (token != "*" && token == headers["Result"]) {
+			record.GameOver, record.Result = true, termination
+		}
+	}
+
+	if headers["Notation"] == "actions" {
+		// Annotations are skipped: comments and NAGs on lines of their own, and variations between lines "(" and ")".
+		depth := 0
+		for _, line := range body {
+			switch {
+			case line == "(":
+				depth++
+				continue
+			case line == ")":
+				depth--
+				continue
+			case depth > 0 || isPGNResult(line) || strings.HasPrefix(line, "{") || strings.HasPrefix(line, "$"):
+				continue
+			}
+			m := pgnActionLine.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("invalid action line %q", line)
+			}
+			if num, _ := strconv.Atoi(m[1]); num != len(record.Actions)+1 {
+				return nil, fmt.Errorf("expected action %d, got %d", len(record.Actions)+1, num)
+			}
+			player := WhitePlayer
+			if m[2] == "..." {
+				player = BlackPlayer
+			}
+			record.Actions = append(record.Actions, importedAction{player, m[3]})
+		}
+		return record, nil
+	}
+
+	moves := pgnComment.ReplaceAllString(strings.Join(body, " "), " ")
+	for _, token := range strings.Fields(moves) {
+		token = pgnMoveNumber.ReplaceAllString(token, "")
+		if token == "" || strings.HasPrefix(token, "$") || isPGNResult(token) {
+			continue
+		}
+		player := WhitePlayer
+		if len(record.Actions)%2 == 1 {
+			player = BlackPlayer
+		}
+		record.Actions = append(record.Actions, importedAction{player, token})
+	}
+	return record, nil
+}
+
+// parseBoardspace reads a record in the format of Boardspace.net, where P0 is white and P1 is black.
+func parseBoardspace(text string) (*parsedRecord, error) {
+	record := &parsedRecord{}
+	for _, m := range sgfProperty.FindAllStringSubmatch(sgfMainLine(text), -1) {
+		name, value := m[1], pgnEscape.ReplaceAllString(m[2], "$1")
+		switch name {
+		case "GM":
+			record.Type = value
+		case "RE":
+			record.GameOver, record.Result = value != "", value
+		case "DT":
+			for _, layout := range []string{"Jan 02 2006", "2006-01-02", "2006.01.02"} {
+				if date, err := time.Parse(layout, value); err == nil {
+					record.Date = date
+					break
+				}
+			}
+		case "P0", "P1":
+			player := WhitePlayer
+			if name == "P1" {
+				player = BlackPlayer
+			}
+			if strings.HasPrefix(value, "id ") {
+				if player == WhitePlayer {
+					record.White = strings.Trim(value[3:], `"`)
+				} else {
+					record.Black = strings.Trim(value[3:], `"`)
+				}
+			} else if act := boardspaceAction.FindStringSubmatch(value); act != nil {
+				// Boardspace starts the game with "0 Start P0", which is not an action.
+				if act[1] == "0" && strings.HasPrefix(strings.ToLower(act[2]), "start") {
+					continue
+				}
+				record.Actions = append(record.Actions, importedAction{player, act[2]})
+			}
+		}
+	}
+	if record.Type == "" {
+		return nil, fmt.Errorf("not a Boardspace record")
+	}
+	return record, nil
+}
+
+// sgfMainLine removes the variations from an SGF record, keeping the first subtree of every node.
+func sgfMainLine(text string) string {
+	var mainLine strings.Builder
+	// taken[d] is true once a subtree at depth d has been kept, so that its siblings are skipped.
+	taken := map[int]bool{}
+	depth, skipDepth := 0, 0
+	inValue, escaped := false, false
+	for _, c := range text {
+		closing := false
+		switch {
+		case escaped:
+			escaped = false
+		case inValue:
+			escaped = c == '\\'
+			inValue = c != ']'
+		case c == '[':
+			inValue = true
+		case c == '(':
+			depth++
+			if skipDepth == 0 && taken[depth] {
+				skipDepth = depth
+			}
+			taken[depth+1] = false
+		case c == ')':
+			closing = true
+		}
+		if skipDepth == 0 {
+			mainLine.WriteRune(c)
+		}
+		if closing {
+			if skipDepth == depth {
+				skipDepth = 0
+			} else if skipDepth == 0 {
+				taken[depth] = true
+			}
+			depth--
+		}
+	}
+	return mainLine.String()
+}
+
+// importedPlayer returns the id of the user with the given screen name if the player may be attributed to them,
+// or -1 and the name to record otherwise.
+func importedPlayer(name string, attribute func(screenName string) bool) (int, string) {
+	if name == "" || name == "?" {
+		return -1, ""
+	}
+	if !attribute(name) {
+		return -1, name
+	}
+	if userID, err := getUserIDFromScreenName(name); err == nil {
+		return userID, ""
+	}
+	return -1, name
+}
+
+// ImportGame creates a game from its record in the given format, attributing its players to the users with their
+// screen names. It is meant for administrators: users importing games can only attribute them to themselves.
+func ImportGame(text string, format RecordFormat) (*Game, error) {
+	return importGame(text, format, func(string) bool { return true })
+}
+
+// importGame creates a game from its record in the given format, attributing the players for which attribute returns
+// true to the users with their screen names. Imported games are not sealed, since the server cannot vouch for games
+// it did not host.
+func importGame(text string, format RecordFormat, attribute func(screenName string) bool) (*Game, error) {
+	var record *parsedRecord
+	var err error
+	switch format {
+	case FormatPGN:
+		record, err = parsePGN(text)
+	case FormatBoardspace:
+		record, err = parseBoardspace(text)
+	default:
+		err = fmt.Errorf("unknown record format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if record.Type == "" {
+		return nil, fmt.Errorf("the record has no game type")
+	}
+	if engine := getRulesEngine(record.Type); engine != nil {
+		actions := make([]string, len(record.Actions))
+		for i, action := range record.Actions {
+			actions[i] = action.Action
+		}
+		if _, err := replayActions(engine, actions); err != nil {
+			return nil, err
+		}
+	}
+
+	whiteUserID, whiteName := importedPlayer(record.White, attribute)
+	blackUserID, blackName := importedPlayer(record.Black, attribute)
+	if whiteUserID != -1 && whiteUserID == blackUserID {
+		blackUserID, blackName = -1, record.Black
+	}
+	var creationTime sql.NullFloat64
+	if !record.Date.IsZero() {
+		creationTime = sql.NullFloat64{Float64: float64(record.Date.UnixMilli()), Valid: true}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	gameID, err := insertGame(tx, record.Type, whiteUserID, blackUserID, true)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`
+		UPDATE games SET imported = 1, white_name = ?, black_name = ?, game_over = ?, game_result = ?,
+			creation_time = COALESCE(?, creation_time)
+		WHERE id = ?
+	`, whiteName, blackName, record.GameOver, record.Result, creationTime, gameID)
+	if err != nil {
+		return nil, err
+	}
+	for i, imported := range record.Actions {
+		action := Action{ActionNum: i + 1, Action: imported.Action}
+		_, err := tx.Exec("INSERT INTO actions(game_id, action_num, action, action_signature, player) VALUES(?, ?, ?, '', ?)",
+			gameID, action.ActionNum, action.Action, imported.Player.String())
+		if err != nil {
+			return nil, err
+		}
+		if err := chainAction(tx, gameID, imported.Player, action); err != nil {
+			return nil, err
+		}
+	}
+	if err := indexGame(tx, gameID, record.GameOver, record.Result); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetGameWithId(gameID)
+}
+
+// checkNotImported returns an error with ErrorNotAllowed if the game was imported.
+func checkNotImported(q queryer, gameID int) error {
+	var imported bool
+	if err := q.QueryRow("SELECT imported FROM games WHERE id = ?", gameID).Scan(&imported); err != nil {
+		return err
+	}
+	if imported {
+		return newCodedError(ErrorNotAllowed, "imported games cannot go on")
+	}
+	return nil
+}
+
+// importGameHandler imports a game for a user, who can only attribute the game to themselves.
+func importGameHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Token  Token  `json:"token"`
+		Format string `json:"format"`
+		Record string `json:"record"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		sendError(w, serverError("incorrect request", err))
+		return
+	}
+	user, err := GetUserWithToken(request.Token)
+	if err != nil {
+		sendError(w, serverError("incorrect token", err))
+		return
+	}
+	serveImport(w, request.Format, request.Record, func(screenName string) bool { return screenName == user.ScreenName })
+}
+
+// handleImportGame imports a game for an administrator, attributing its players to the users with their screen names.
+func handleImportGame(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Format string `json:"format"`
+		Record string `json:"record"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendError(w, serverError("incorrect request", err))
+		return
+	}
+	serveImport(w, request.Format, request.Record, func(string) bool { return true })
+}
+
+func serveImport(w http.ResponseWriter, formatName string, text string, attribute func(screenName string) bool) {
+	format, err := parseRecordFormat(formatName)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	game, err := importGame(text, format, attribute)
+	if err != nil {
+		sendError(w, fmt.Errorf("cannot import game: %v", err))
+		return
+	}
+	// Nobody plays an imported game.
+	game.WhiteToken = ""
+	game.BlackToken = ""
+	writeJSONResponse(w, game)
+}
@@ -0,0 +1,145 @@
+package gameserver_test
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vkryukov/gameserver"
+)
+
+// countingRules is a rules engine for a game where the players count up from 1, one number per action.
+type countingRules struct{}
+
+type countingState int
+
+func (countingRules) InitialState() gameserver.GameState {
+	return countingState(0)
+}
+
+func (s countingState) Apply(action string) (gameserver.GameState, error) {
+	if n, err := strconv.Atoi(action); err != nil || n != int(s)+1 {
+		return nil, fmt.Errorf("expected %d", int(s)+1)
+	}
+	return s + 1, nil
+}
+
+func init() {
+	gameserver.RegisterRulesEngine("Counting", countingRules{})
+}
+
+func mustImportGame(t *testing.T, record string, format gameserver.RecordFormat) *gameserver.Game {
+	game, err := gameserver.ImportGame(record, format)
+	if err != nil {
+		t.Fatalf("Failed to import game: %v\n%s", err, record)
+	}
+	return game
+}
+
+func TestImportExportedGames(t *testing.T) {
+	original := mustPlayGame(t, []string{"a", "b c", "d"}, "Game won by white")
+	original, _ = gameserver.GetGameWithId(original.Id)
+	recordKey, _ := gameserver.RecordPublicKey()
+
+	for _, format := range []gameserver.RecordFormat{gameserver.FormatPGN, gameserver.FormatBoardspace} {
+		record, err := gameserver.ExportGame(original.Id, format)
+		if err != nil {
+			t.Fatalf("Failed to export game: %v", err)
+		}
+		game := mustImportGame(t, record, format)
+		if !game.Imported || game.WhitePlayer != original.WhitePlayer || game.BlackPlayer != original.BlackPlayer ||
+			game.GameRecord != original.GameRecord || !game.GameOver || game.GameResult != original.GameResult {
+			t.Fatalf("Unexpected game imported from %s: %s", format, mustPrettyPrint(t, game))
+		}
+		bundle, _ := gameserver.ExportRecord(game.Id)
+		if bundle.Signature != "" || bundle.Actions[1].Player != "black" {
+			t.Fatalf("Unexpected record of the game imported from %s: %s", format, mustPrettyPrint(t, bundle))
+		}
+		if err := gameserver.VerifyRecord(bundle, recordKey); err == nil || !strings.Contains(err.Error(), "imported") {
+			t.Fatalf("Expected the record of the game imported from %s to be unverifiable, got %v", format, err)
+		}
+	}
+}
+
+func TestImportGames(t *testing.T) {
+	user := mustRegisterAndAuthenticateRandomUser(t)
+
+	// Test 1: standard PGN records with unknown players
+	record := "[Event \"Casual\"]\n[GameType \"Yinsh\"]\n[White \"Somebody Else\"]\n[Black \"" + user.ScreenName + "\"]\n" +
+		"[Result \"0-1\"]\n\n1. a1 {a comment} b2 2. c3 d4 0-1\n"
+	var game gameserver.Game
+	mustDecodeRequestWithObject(t, "http://localhost:1234/game/import",
+		map[string]interface{}{"token": user.Token, "format": "pgn", "record": record}, &game)
+	if game.WhitePlayer != "Somebody Else" || game.BlackPlayer != user.ScreenName || game.GameRecord != "a1 b2 c3 d4" ||
+		game.GameResult != "Game won by black" || game.BlackToken != "" {
+		t.Fatalf("Unexpected imported game: %s", mustPrettyPrint(t, game))
+	}
+
+	// Test 2: users can only attribute the games they import to themselves
+	other := mustRegisterAndAuthenticateRandomUser(t)
+	record = strings.Replace(record, "Somebody Else", other.ScreenName, 1)
+	var attributed gameserver.Game
+	mustDecodeRequestWithObject(t, "http://localhost:1234/game/import",
+		map[string]interface{}{"token": user.Token, "format": "pgn", "record": record}, &attributed)
+	var games []*gameserver.Game
+	mustDecodeRequestWithObject(t, "http://localhost:1234/game/list/byuser", struct{ Token gameserver.Token }{other.Token}, &games)
+	if attributed.WhitePlayer != other.ScreenName || len(games) != 0 {
+		t.Fatalf("Expected the game not to be attributed to %s: %s", other.ScreenName, mustPrettyPrint(t, games))
+	}
+	mustDecodeRequestWithObject(t, "http://localhost:1234/game/list/byuser", struct{ Token gameserver.Token }{user.Token}, &games)
+	if len(games) != 2 {
+		t.Fatalf("Expected the games to be attributed to %s: %s", user.ScreenName, mustPrettyPrint(t, games))
+	}
+
+	// Test 3: imported games cannot be joined
+	if resp := joinGame(t, mustRegisterAndAuthenticateRandomUser(t), &game); !isErrorResponse(resp, "game is full") {
+		t.Fatalf("Expected the imported game to be full, got %s", resp)
+	}
+
+	// Test 4: actions are checked by the rules engine of the game type
+	record = "(;\nGM[Counting]VV[1]\n; P0[0 Start P0]\n; P0[1 1]\n; P1[2 2]\n; P0[3 3]\n)\n"
+	if game := mustImportGame(t, record, gameserver.FormatBoardspace); game.NumActions != 3 || game.GameOver {
+		t.Fatalf("Unexpected imported game: %s", mustPrettyPrint(t, game))
+	}
+	record = strings.Replace(record, "P0[3 3]", "P0[3 4]", 1)
+	if _, err := gameserver.ImportGame(record, gameserver.FormatBoardspace); err == nil || !strings.Contains(err.Error(), "action 3") {
+		t.Fatalf("Expected an illegal action error, got %v", err)
+	}
+
+	// Test 5: Termination only replaces Result when it agrees with it, or when there is no winner nor draw
+	for _, test := range []struct{ result, termination, expected string }{
+		{"1-0", "normal", "Game won by white"},
+		{"1-0", "Game won by black", "Game won by white"},
+		{"1-0", "Game won by white: black abandoned the game", "Game won by white: black abandoned the game"},
+		{"*", "Aborted: black abandoned the game", "Aborted: black abandoned the game"},
+	} {
+		record := fmt.Sprintf("[GameType \"Yinsh\"]\n[Result \"%s\"]\n[Termination \"%s\"]\n\n1. a1 b2 %s\n",
+			test.result, test.termination, test.result)
+		game, err := gameserver.ImportGame(record, gameserver.FormatPGN)
+		if err != nil || !game.GameOver || game.GameResult != test.expected {
+			t.Fatalf("Expected %q for %s and %q, got %+v (%v)", test.expected, test.result, test.termination, game, err)
+		}
+	}
+
+	// Test 6: imported games cannot go on, even for the players they are attributed to
+	record = "[GameType \"Yinsh\"]\n[White \"Somebody Else\"]\n[Black \"" + user.ScreenName + "\"]\n[Result \"*\"]\n\n1. a1 b2 *\n"
+	mustDecodeRequestWithObject(t, "http://localhost:1234/game/import",
+		map[string]interface{}{"token": user.Token, "format": "pgn", "record": record}, &game)
+	var resp struct {
+		Error     string               `json:"error"`
+		ErrorCode gameserver.ErrorCode `json:"error_code"`
+	}
+	mustDecodeRequestWithObject(t, fmt.Sprintf("http://localhost:1234/game/%d/actions", game.Id),
+		map[string]interface{}{"token": user.Token, "action_num": 3, "action": "c3"}, &resp)
+	if game.GameOver || resp.ErrorCode != gameserver.ErrorNotAllowed {
+		t.Fatalf("Expected the action to be refused, got %+v", resp)
+	}
+	conn := mustDialWS(t)
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, conn, "GameJoined")
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user.Token, Type: "GameOver", Message: "Game won by black"})
+	if resp := mustReadWSMessageOfType(t, conn, "Error"); resp.ErrorCode != gameserver.ErrorNotAllowed {
+		t.Fatalf("Expected the end of the game to be refused, got %s", mustPrettyPrint(t, resp))
+	}
+}
@@ -0,0 +1,71 @@
+// limits.go protects the server from dead and misbehaving WebSocket connections: it keeps read deadlines fresh
+// while the peer answers pings, limits the rate of incoming messages, and closes connections with a close code
+// explaining why they were dropped. The maximum message size is enforced by the websocket library, which closes
+// oversized connections with CloseMessageTooBig.
+
+package gameserver
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// setupReading applies the configured read limits to the connection. It must be called before the first read.
+func (c Conn) setupReading() {
+	if c.config.MaxMessageSize > 0 {
+		c.SetReadLimit(c.config.MaxMessageSize)
+	}
+	c.extendReadDeadline()
+	c.SetPongHandler(func(string) error {
+		c.extendReadDeadline()
+		return nil
+	})
+}
+
+// extendReadDeadline gives the peer another PongTimeout to show that it is alive.
+func (c Conn) extendReadDeadline() {
+	if c.config.PongTimeout > 0 {
+		c.SetReadDeadline(time.Now().Add(c.config.PongTimeout))
+	}
+}
+
+// closeWithReason tells the peer why the connection is being dropped, and closes it.
+func (c Conn) closeWithReason(code int, reason string) {
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(c.config.WriteTimeout))
+	c.Close()
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// rateLimiter is a token bucket allowing rate events per second on average, and bursts of up to burst events.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow reports whether another event may happen now, and if so, records it.
+func (r *rateLimiter) allow() bool {
+	if r.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	r.tokens = min(r.burst, r.tokens+now.Sub(r.last).Seconds()*r.rate)
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
@@ -0,0 +1,219 @@
+// lobby.go implements the real-time lobby: WebSocket connections that subscribe to it receive a snapshot of
+// open seeks and live games, followed by events as seeks are created, joined or cancelled, games finish,
+// and users come online or go offline. A user with several connections is counted once.
+
+package gameserver
+
+import (
+	"log"
+	"sync"
+)
+
+var (
+	lobbySubscribers = make(map[Conn]bool)
+	// onlineConns maps the open connections to the id of the user they belong to, or 0 for guests.
+	onlineConns = make(map[Conn]int)
+	// onlineUsers counts the open connections of each user, and onlineGuests the connections of guests.
+	onlineUsers  = make(map[int]int)
+	onlineGuests int
+	lobbyMu      sync.Mutex
+)
+
+// LobbySnapshot is sent to a connection when it subscribes to the lobby.
+type LobbySnapshot struct {
+	Seeks     []*Game `json:"seeks"`
+	LiveGames []*Game `json:"live_games"`
+	// Online is the number of users connected to the server, where each guest connection counts as a user.
+	Online int `json:"online"`
+}
+
+func isLobbyMessage(messageType string) bool {
+	return messageType == "SubscribeLobby" || messageType == "UnsubscribeLobby"
+}
+
+func processLobbyMessage(conn Conn, message WebSocketMessage) {
+	switch message.Type {
+	case "SubscribeLobby":
+		if user, err := GetUserWithToken(message.Token); err == nil {
+			setConnectionUser(conn, user.Id)
+		}
+		snapshot, err := getLobbySnapshot()
+		if handleError(conn, message, err) {
+			return
+		}
+		lobbyMu.Lock()
+		lobbySubscribers[conn] = true
+		lobbyMu.Unlock()
+		sendReply(conn, message, "Lobby", snapshot)
+
+	case "UnsubscribeLobby":
+		removeLobbySubscriber(conn)
+	}
+}
+
+func getLobbySnapshot() (*LobbySnapshot, error) {
+	seeks, err := getGamesWithQuery(`
+		SELECT
+			g.id, g.type, u1.screen_name, u2.screen_name, g.white_token, g.black_token, g.viewer_token, g.game_over, g.game_result, g.creation_time,
+			0 AS num_actions
+		FROM games g
+		LEFT JOIN users u1 ON g.white_user_id = u1.id
+		LEFT JOIN users u2 ON g.black_user_id = u2.id
+		WHERE (g.white_user_id = -1 OR g.black_user_id = -1) AND g.viewer_token = '' AND g.imported = 0
+		GROUP BY g.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	liveGames, err := getGamesWithQuery(`
+		SELECT
+			g.id, g.type, u1.screen_name, u2.screen_name, g.white_token, g.black_token, g.viewer_token, g.game_over, g.game_result, g.creation_time,
+			(SELECT COUNT(*) FROM actions a WHERE g.id = a.game_id) AS num_actions
+		FROM games g
+		LEFT JOIN users u1 ON g.white_user_id = u1.id
+		LEFT JOIN users u2 ON g.black_user_id = u2.id
+		WHERE g.white_user_id != -1 AND g.black_user_id != -1 AND g.viewer_token = '' AND g.game_over = 0 AND g.imported = 0
+		GROUP BY g.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	for _, game := range append(seeks, liveGames...) {
+		game.WhiteToken = ""
+		game.BlackToken = ""
+	}
+
+	lobbyMu.Lock()
+	defer lobbyMu.Unlock()
+	return &LobbySnapshot{Seeks: seeks, LiveGames: liveGames, Online: onlineCount()}, nil
+}
+
+func removeLobbySubscriber(conn Conn) {
+	lobbyMu.Lock()
+	delete(lobbySubscribers, conn)
+	lobbyMu.Unlock()
+}
+
+// broadcastToLobby sends a message to all lobby subscribers. The caller must hold lobbyMu.
+func broadcastToLobby(messageType string, data any) {
+	message, err := newJSONMessage(0, messageType, data)
+	if err != nil {
+		return
+	}
+	for conn := range lobbySubscribers {
+		if err := conn.Send(message); err != nil {
+			log.Printf("Failed to send lobby message to conn %s: %v", conn, err)
+			delete(lobbySubscribers, conn)
+		}
+	}
+}
+
+func notifyLobby(messageType string, data any) {
+	lobbyMu.Lock()
+	defer lobbyMu.Unlock()
+	broadcastToLobby(messageType, data)
+}
+
+// onlineCount returns the number of users connected to the server. The caller must hold lobbyMu.
+func onlineCount() int {
+	return len(onlineUsers) + onlineGuests
+}
+
+// setConnectionUser records that the open connection belongs to the user with the given id, 0 for a guest, or -1 once
+// the connection is closed, and announces the number of users online to the lobby if it has changed.
+func setConnectionUser(conn Conn, userID int) {
+	lobbyMu.Lock()
+	defer lobbyMu.Unlock()
+	previous, open := onlineConns[conn]
+	if open && previous == userID {
+		return
+	}
+	online := onlineCount()
+	if open {
+		if previous == 0 {
+			onlineGuests--
+		} else if onlineUsers[previous]--; onlineUsers[previous] == 0 {
+			delete(onlineUsers, previous)
+		}
+	}
+	switch {
+	case userID < 0:
+		delete(onlineConns, conn)
+		delete(lobbySubscribers, conn)
+	case userID == 0:
+		onlineConns[conn] = 0
+		onlineGuests++
+	default:
+		onlineConns[conn] = userID
+		onlineUsers[userID]++
+	}
+	if onlineCount() != online {
+		broadcastToLobby("OnlineUsers", map[string]int{"online": onlineCount()})
+	}
+}
+
+func lobbyConnectionOpened(conn Conn) {
+	setConnectionUser(conn, 0)
+}
+
+func lobbyConnectionClosed(conn Conn) {
+	setConnectionUser(conn, -1)
+}
+
+// lobbyPlayerIdentified records that the connection belongs to the user playing the game as the given player, if any.
+func lobbyPlayerIdentified(conn Conn, gameID int, player PlayerType) {
+	var column string
+	switch player {
+	case WhitePlayer:
+		column = "white_user_id"
+	case BlackPlayer:
+		column = "black_user_id"
+	default:
+		return
+	}
+	var userID int
+	if err := db.QueryRow("SELECT "+column+" FROM games WHERE id = ?", gameID).Scan(&userID); err == nil && userID > 0 {
+		setConnectionUser(conn, userID)
+	}
+}
+
+// lobbyInfo returns a copy of the game without the player tokens, suitable for sending to everyone.
+func lobbyInfo(game *Game) *Game {
+	info := *game
+	info.WhiteToken = ""
+	info.BlackToken = ""
+	return &info
+}
+
+// lobbyGameCreated announces a new public game either as a seek, if it has an open seat, or as a live game.
+func lobbyGameCreated(game *Game) {
+	if !game.Public {
+		return
+	}
+	if game.WhitePlayer == "" || game.BlackPlayer == "" {
+		notifyLobby("SeekCreated", lobbyInfo(game))
+	} else {
+		notifyLobby("GameStarted", lobbyInfo(game))
+	}
+}
+
+// lobbySeekJoined announces that a public seek has been joined and is now a live game.
+func lobbySeekJoined(game *Game) {
+	if game.Public {
+		notifyLobby("SeekJoined", lobbyInfo(game))
+	}
+}
+
+func lobbySeekCancelled(game *Game) {
+	if game.Public {
+		notifyLobby("SeekCancelled", map[string]int{"id": game.Id})
+	}
+}
+
+func lobbyGameFinished(gameID int, result string) {
+	var viewerToken Token
+	if err := db.QueryRow("SELECT viewer_token FROM games WHERE id = ?", gameID).Scan(&viewerToken); err != nil || viewerToken != "" {
+		return
+	}
+	notifyLobby("GameFinished", map[string]interface{}{"id": gameID, "game_result": result})
+}
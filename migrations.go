@@ -0,0 +1,96 @@
+// migrations.go brings databases created by earlier versions of the server up to date. CREATE TABLE IF NOT EXISTS
+// leaves existing tables alone, so the columns and indexes added to them since are added by migrations instead.
+// Migrations are idempotent, so that they can run on new databases as well, and the number of migrations applied to
+// a database is stored in its user_version.
+
+package gameserver
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+type migration func(tx *sql.Tx) error
+
+// migrations must only ever be appended to.
+var migrations = []migration{
+	addColumn("games", "rematch_game_id", "INTEGER DEFAULT 0"),
+	addColumn("users", "last_seen", "REAL DEFAULT 0"),
+	addColumn("actions", "client_action_id", "TEXT"),
+	execMigration("CREATE UNIQUE INDEX IF NOT EXISTS actions_client_action_id ON actions(game_id, client_action_id)"),
+	addColumn("games", "white_public_key", "TEXT DEFAULT ''"),
+	addColumn("games", "black_public_key", "TEXT DEFAULT ''"),
+	addColumn("actions", "player", "TEXT DEFAULT ''"),
+	addColumn("games", "record_head", "TEXT DEFAULT ''"),
+	addColumn("games", "record_signature", "TEXT DEFAULT ''"),
+	addColumn("games", "record_key", "TEXT DEFAULT ''"),
+	addColumn("actions", "chain_hash", "TEXT DEFAULT ''"),
+	chainActions,
+	addColumn("games", "imported", "INTEGER DEFAULT 0"),
+	addColumn("games", "white_name", "TEXT DEFAULT ''"),
+	addColumn("games", "black_name", "TEXT DEFAULT ''"),
+	addColumn("games", "from_game_id", "INTEGER DEFAULT 0"),
+	addColumn("games", "from_action_num", "INTEGER DEFAULT 0"),
+	addColumn("games", "open_annotations", "INTEGER DEFAULT 0"),
+	addColumn("games", "white_last_seen", "REAL DEFAULT 0"),
+	addColumn("games", "black_last_seen", "REAL DEFAULT 0"),
+	indexOpenings,
+}
+
+// addColumn returns a migration adding the column to the table, unless it is already there.
+func addColumn(table, column, definition string) migration {
+	return func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM pragma_table_info(?) WHERE name = ?)", table, column).Scan(&exists)
+		if err != nil || exists {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+		return err
+	}
+}
+
+// execMigration returns a migration executing the statement, which must be idempotent.
+func execMigration(statement string) migration {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statement)
+		return err
+	}
+}
+
+// migrate applies the migrations that have not been applied to the database yet.
+func migrate(conn *sql.DB) error {
+	var version int
+	if err := conn.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := conn.Begin()
+		if err != nil {
+			return err
+		}
+		if err := migrations[version](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", version+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateDB brings the database at the given path up to date, like InitDB, without making it the database of the
+// server. It lets administrators upgrade a database before deploying a new version of the server.
+func MigrateDB(path string) error {
+	conn, err := sql.Open("sqlite3", setupPath(path))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return createSchema(conn)
+}
@@ -0,0 +1,136 @@
+package gameserver_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/vkryukov/gameserver"
+)
+
+// originalSchema is the schema of the databases created by the first version of the server, with a finished game.
+const originalSchema = `
+	CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT UNIQUE,
+		email_verified INTEGER DEFAULT 0,
+		password_hash TEXT,
+		screen_name TEXT UNIQUE,
+		is_admin INTEGER DEFAULT 0,
+		creation_time REAL DEFAULT ((julianday('now') - 2440587.5)*86400000)
+	);
+	CREATE TABLE tokens (
+		user_id INTEGER,
+		token TEXT,
+		creation_time REAL DEFAULT ((julianday('now') - 2440587.5)*86400000),
+		PRIMARY KEY (user_id, token),
+		FOREIGN KEY (user_id) REFERENCES users(user_id)
+	);
+	CREATE TABLE games (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type TEXT,
+		white_user_id INTEGER DEFAULT -1,
+		black_user_id INTEGER DEFAULT -1,
+		white_token TEXT,
+		black_token TEXT,
+		viewer_token TEXT,
+		game_over INTEGER DEFAULT 0,
+		game_result TEXT DEFAULT "",
+		creation_time REAL DEFAULT ((julianday('now') - 2440587.5)*86400000)
+	);
+	CREATE TABLE actions (
+		game_id INTEGER,
+		action_num INTEGER,
+		action TEXT,
+		action_signature TEXT,
+		creation_time REAL DEFAULT ((julianday('now') - 2440587.5)*86400000),
+		PRIMARY KEY (game_id, action_num)
+	);
+
+	INSERT INTO users(email, password_hash, screen_name) VALUES('old@example.com', 'hash', 'old');
+	INSERT INTO games(type, white_user_id, white_token, black_token, viewer_token, game_over, game_result)
+		VALUES('Gipf', 1, 'white', 'black', '', 1, 'Game won by white');
+	INSERT INTO actions(game_id, action_num, action, action_signature) VALUES(1, 1, 'a', NULL);
+	INSERT INTO actions(game_id, action_num, action, action_signature) VALUES(1, 2, 'b', '');
+`
+
+// mustCreateOriginalDB creates a database with the original schema, and returns its path.
+func mustCreateOriginalDB(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "original.db")
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Exec(originalSchema); err != nil {
+		t.Fatalf("Failed to create the original schema: %v", err)
+	}
+	return path
+}
+
+func TestMigrateOriginalSchema(t *testing.T) {
+	path := mustCreateOriginalDB(t)
+
+	// Test 1: the database can be migrated, more than once
+	for i := 0; i < 2; i++ {
+		if err := gameserver.MigrateDB(path); err != nil {
+			t.Fatalf("Failed to migrate the database: %v", err)
+		}
+	}
+
+	// Test 2: the existing rows have the new columns, with their default values
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer conn.Close()
+	var lastSeen float64
+	if err := conn.QueryRow("SELECT last_seen FROM users WHERE screen_name = 'old'").Scan(&lastSeen); err != nil || lastSeen != 0 {
+		t.Fatalf("Unexpected last_seen %v: %v", lastSeen, err)
+	}
+	var rematchGameID, fromGameID, openAnnotations int
+	err = conn.QueryRow("SELECT rematch_game_id, from_game_id, open_annotations FROM games WHERE id = 1").
+		Scan(&rematchGameID, &fromGameID, &openAnnotations)
+	if err != nil || rematchGameID != 0 || fromGameID != 0 || openAnnotations != 0 {
+		t.Fatalf("Unexpected game columns %d %d %d: %v", rematchGameID, fromGameID, openAnnotations, err)
+	}
+	var numActions int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM actions WHERE game_id = 1 AND player = ''").Scan(&numActions); err != nil || numActions != 2 {
+		t.Fatalf("Expected 2 migrated actions, got %d: %v", numActions, err)
+	}
+
+	// Test 3: the actions are chained, and the finished game is reported as unverifiable rather than altered
+	bundle := gameserver.RecordBundle{GameID: 1, GameOver: true, GameResult: "Game won by white"}
+	rows, err := conn.Query("SELECT action_num, player, action, COALESCE(action_signature, ''), chain_hash FROM actions WHERE game_id = 1 ORDER BY action_num")
+	if err != nil {
+		t.Fatalf("Failed to read actions: %v", err)
+	}
+	for rows.Next() {
+		var action gameserver.RecordAction
+		if err := rows.Scan(&action.ActionNum, &action.Player, &action.Action, &action.Signature, &action.Hash); err != nil {
+			t.Fatalf("Failed to read action: %v", err)
+		}
+		if action.Hash == "" {
+			t.Fatalf("Expected action %d to be chained", action.ActionNum)
+		}
+		bundle.Actions = append(bundle.Actions, action)
+	}
+	rows.Close()
+	if err := gameserver.VerifyRecord(&bundle, nil); err == nil || !strings.Contains(err.Error(), "cannot be verified") {
+		t.Fatalf("Expected the record to be unverifiable, got %v", err)
+	}
+
+	// Test 4: the games are indexed in the opening explorer once
+	var games, whiteWins int
+	err = conn.QueryRow("SELECT SUM(games), SUM(white_wins) FROM openings WHERE game_type = 'Gipf'").Scan(&games, &whiteWins)
+	if err != nil || games != 2 || whiteWins != 2 {
+		t.Fatalf("Unexpected opening index: %d games, %d white wins: %v", games, whiteWins, err)
+	}
+
+	// Test 5: client action ids are unique within a game
+	if _, err := conn.Exec("UPDATE actions SET client_action_id = 'x' WHERE game_id = 1"); err == nil {
+		t.Fatalf("Expected duplicate client action ids to be rejected")
+	}
+}
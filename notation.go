@@ -0,0 +1,341 @@
+// notation.go exports game records as text files in standard notations: a PGN-like format for the games of the GIPF
+// project, and the game record format of Boardspace.net. A user's games can also be exported all at once as a zip
+// archive.
+//
+// The server has no ratings or clocks, so the corresponding headers are written as unknown.
+
+package gameserver
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type RecordFormat string
+
+const (
+	FormatPGN        RecordFormat = "pgn"
+	FormatBoardspace RecordFormat = "boardspace"
+)
+
+// extension returns the usual file extension of records in the format.
+func (f RecordFormat) extension() string {
+	if f == FormatBoardspace {
+		return "sgf"
+	}
+	return "pgn"
+}
+
+func parseRecordFormat(format string) (RecordFormat, error) {
+	switch RecordFormat(format) {
+	case "", FormatPGN:
+		return FormatPGN, nil
+	case FormatBoardspace:
+		return FormatBoardspace, nil
+	}
+	return "", fmt.Errorf("unknown record format %q", format)
+}
+
+// ExportGame returns the record of the game in the given format.
+func ExportGame(gameID int, format RecordFormat) (string, error) {
+	game, err := GetGameWithId(gameID)
+	if err != nil {
+		return "", err
+	}
+	actions, err := getRecordActions(gameID)
+	if err != nil {
+		return "", err
+	}
+	for i := range actions {
+		if actions[i].Player == "" {
+			// The players of actions made before players were recorded are unknown.
+			actions[i].Player = defaultPlayer(actions[i].ActionNum).String()
+		}
+	}
+	annotations, err := GetAnnotations(gameID)
+	if err != nil {
+		return "", err
+	}
+	tree := newAnnotationTree(annotations)
+	switch format {
+	case FormatPGN:
+		return formatPGN(game, actions, tree), nil
+	case FormatBoardspace:
+		return formatBoardspace(game, actions, tree), nil
+	}
+	return "", fmt.Errorf("unknown record format %q", format)
+}
+
+// resultToken returns the PGN result of the game.
+func resultToken(game *Game) string {
+	result := strings.ToLower(game.GameResult)
+	switch {
+	case !game.GameOver:
+		return "*"
+	case strings.Contains(result, "won by white"):
+		return "1-0"
+	case strings.Contains(result, "won by black"):
+		return "0-1"
+	case strings.Contains(result, "draw"):
+		return "1/2-1/2"
+	}
+	return "*"
+}
+
+func formatDate(creationTime int, layout string) string {
+	return time.UnixMilli(int64(creationTime)).UTC().Format(layout)
+}
+
+// formatPGN writes the record with PGN headers, followed by one action per line: white's actions are numbered
+// like "12." and black's like "12...", where the number is the number of the action. Since actions may contain
+// spaces, this departs from standard PGN, which the "Notation" header tells readers.
+func formatPGN(game *Game, actions []RecordAction, tree annotationTree) string {
+	var record strings.Builder
+	header := func(name, value string) {
+		value = strings.ReplaceAll(value, `\`, `\\`)
+		value = strings.ReplaceAll(value, `"`, `\"`)
+		fmt.Fprintf(&record, "[%s \"%s\"]\n", name, value)
+	}
+	header("Event", fmt.Sprintf("Game %d", game.Id))
+	header("Site", "gameserver")
+	header("Date", formatDate(game.CreationTime, "2006.01.02"))
+	header("Round", "-")
+	header("White", game.WhitePlayer)
+	header("Black", game.BlackPlayer)
+	header("Result", resultToken(game))
+	header("GameType", game.Type)
+	header("WhiteElo", "?")
+	header("BlackElo", "?")
+	header("TimeControl", "-")
+	header("Notation", "actions")
+	if game.GameResult != "" {
+		header("Termination", game.GameResult)
+	}
+	record.WriteString("\n")
+	writePGNLine(&record, tree, mainLine(actions))
+	record.WriteString(resultToken(game) + "\n")
+	return record.String()
+}
+
+// formatBoardspace writes the record in the SGF-like format of Boardspace.net, where white is player P0 and black P1.
+func formatBoardspace(game *Game, actions []RecordAction, tree annotationTree) string {
+	escape := sgfEscape
+	var record strings.Builder
+	record.WriteString("(;\n")
+	fmt.Fprintf(&record, "GM[%s]VV[1]\n", escape(game.Type))
+	fmt.Fprintf(&record, "SU[%s]\n", escape(strings.ToLower(game.Type)))
+	fmt.Fprintf(&record, "P0[id \"%s\"]\n", escape(game.WhitePlayer))
+	fmt.Fprintf(&record, "P1[id \"%s\"]\n", escape(game.BlackPlayer))
+	fmt.Fprintf(&record, "DT[%s]\n", formatDate(game.CreationTime, "Jan 02 2006"))
+	if game.GameOver {
+		fmt.Fprintf(&record, "RE[%s]\n", escape(game.GameResult))
+	}
+	writeSGFLine(&record, tree, mainLine(actions), false)
+	record.WriteString(")\n")
+	return record.String()
+}
+
+// sgfEscape escapes the value of an SGF property.
+var sgfEscape = strings.NewReplacer(`\`, `\\`, `]`, `\]`).Replace
+
+// annotatedLine is a line of play in an exported record: the main line of the game, or the variation of an annotation.
+type annotatedLine struct {
+	parentID int // the annotation whose variation this is, or 0 for the main line
+	start    int // the number of the first action
+	actions  []string
+	players  []string
+	head     *Annotation // the annotation of a variation, whose comment and symbol refer to its first action
+}
+
+func mainLine(actions []RecordAction) annotatedLine {
+	line := annotatedLine{start: 1}
+	for _, action := range actions {
+		line.actions = append(line.actions, action.Action)
+		line.players = append(line.players, action.Player)
+	}
+	return line
+}
+
+func variationLine(annotation *Annotation) annotatedLine {
+	line := annotatedLine{parentID: annotation.Id, start: annotation.ActionNum, actions: annotation.Variation, head: annotation}
+	line.players = annotation.Players
+	if len(line.players) != len(line.actions) {
+		// The players of variations added before they were recorded are unknown.
+		line.players = nil
+		for i := range annotation.Variation {
+			line.players = append(line.players, defaultPlayer(annotation.ActionNum+i).String())
+		}
+	}
+	return line
+}
+
+// from returns the rest of the line starting with its i-th action.
+func (line annotatedLine) from(i int) annotatedLine {
+	rest := annotatedLine{parentID: line.parentID, start: line.start + i, actions: line.actions[i:], players: line.players[i:]}
+	if i == 0 {
+		rest.head = line.head
+	}
+	return rest
+}
+
+// notes returns the annotations without variations of the i-th action of the line, and its alternatives.
+func (line annotatedLine) notes(tree annotationTree, i int) (notes, alternatives []*Annotation) {
+	if i == 0 && line.head != nil {
+		notes = append(notes, line.head)
+	}
+	for _, annotation := range tree.at(line.parentID, line.start+i) {
+		if len(annotation.Variation) == 0 {
+			notes = append(notes, annotation)
+		} else {
+			alternatives = append(alternatives, annotation)
+		}
+	}
+	return notes, alternatives
+}
+
+// writePGNLine writes the actions of the line one per line, each followed by its evaluation symbols as NAGs, its
+// comments in braces, and its alternatives in parentheses.
+func writePGNLine(record *strings.Builder, tree annotationTree, line annotatedLine) {
+	comment := strings.NewReplacer("}", ")", "\n", " ").Replace
+	for i, action := range line.actions {
+		separator := "."
+		if line.players[i] == BlackPlayer.String() {
+			separator = "..."
+		}
+		fmt.Fprintf(record, "%d%s %s\n", line.start+i, separator, action)
+		notes, alternatives := line.notes(tree, i)
+		for _, note := range notes {
+			if note.Symbol != "" {
+				fmt.Fprintf(record, "$%d\n", annotationSymbols[note.Symbol].nag)
+			}
+			if note.Comment != "" {
+				fmt.Fprintf(record, "{%s}\n", comment(note.Comment))
+			}
+		}
+		for _, alternative := range alternatives {
+			record.WriteString("(\n")
+			writePGNLine(record, tree, variationLine(alternative))
+			record.WriteString(")\n")
+		}
+	}
+}
+
+// writeSGFLine writes the actions of the line as a sequence of nodes, with the evaluation symbols and comments of
+// each action as properties of its node. Where an action has alternatives, the rest of the line and the alternatives
+// are written as sibling subtrees. If branched is true, the alternatives of the first action have been written already.
+func writeSGFLine(record *strings.Builder, tree annotationTree, line annotatedLine, branched bool) {
+	escape := sgfEscape
+	for i, action := range line.actions {
+		notes, alternatives := line.notes(tree, i)
+		if len(alternatives) > 0 && (i > 0 || !branched) {
+			record.WriteString("(\n")
+			writeSGFLine(record, tree, line.from(i), true)
+			record.WriteString(")\n")
+			for _, alternative := range alternatives {
+				record.WriteString("(\n")
+				writeSGFLine(record, tree, variationLine(alternative), false)
+				record.WriteString(")\n")
+			}
+			return
+		}
+
+		player := "P0"
+		if line.players[i] == BlackPlayer.String() {
+			player = "P1"
+		}
+		fmt.Fprintf(record, "; %s[%d %s]", player, line.start+i, escape(action))
+		var comments []string
+		for _, note := range notes {
+			if note.Symbol != "" {
+				record.WriteString(annotationSymbols[note.Symbol].sgf)
+			}
+			if note.Comment != "" {
+				comments = append(comments, note.Comment)
+			}
+		}
+		if len(comments) > 0 {
+			fmt.Fprintf(record, "C[%s]", escape(strings.Join(comments, "\n")))
+		}
+		record.WriteString("\n")
+	}
+}
+
+// exportGameHandler serves GET prefix/{id}/export, which returns the record of the game in the format given
+// by the "format" query parameter ("pgn" or "boardspace"). Private games require a token in the "token" query parameter.
+func exportGameHandler(w http.ResponseWriter, r *http.Request, gameID int) {
+	format, err := parseRecordFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	game, err := GetGameWithId(gameID)
+	if err != nil {
+		sendError(w, serverError("cannot find game", err))
+		return
+	}
+	if !canWatch(r, game) {
+		sendError(w, serverError("invalid token", nil))
+		return
+	}
+	record, err := ExportGame(gameID, format)
+	if err != nil {
+		sendError(w, serverError("cannot export game", err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"game-%d.%s\"", gameID, format.extension()))
+	w.Write([]byte(record))
+}
+
+// exportUserGamesHandler returns a zip archive with the records of all the games of the user.
+func exportUserGamesHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Token  Token  `json:"token"`
+		Format string `json:"format"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		sendError(w, serverError("incorrect request", err))
+		return
+	}
+	format, err := parseRecordFormat(request.Format)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	user, err := GetUserWithToken(request.Token)
+	if err != nil {
+		sendError(w, serverError("incorrect token", err))
+		return
+	}
+	games, err := listGamesByUser(user)
+	if err != nil {
+		sendError(w, serverError("cannot list games", err))
+		return
+	}
+
+	// Export all the records before writing anything, so that errors can still be reported.
+	records := make([]string, len(games))
+	for i, game := range games {
+		records[i], err = ExportGame(game.Id, format)
+		if err != nil {
+			sendError(w, serverError("cannot export game", err))
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-games.zip\"", user.ScreenName))
+	archive := zip.NewWriter(w)
+	for i, game := range games {
+		file, err := archive.Create(fmt.Sprintf("game-%d.%s", game.Id, format.extension()))
+		if err != nil {
+			return
+		}
+		file.Write([]byte(records[i]))
+	}
+	archive.Close()
+}
@@ -0,0 +1,67 @@
+package gameserver_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/vkryukov/gameserver"
+)
+
+func TestExportGame(t *testing.T) {
+	game := mustPlayGame(t, []string{"a", "b c"}, "Game won by white")
+
+	// Test 1: PGN-like records have headers and one action per line
+	record, err := gameserver.ExportGame(game.Id, gameserver.FormatPGN)
+	if err != nil {
+		t.Fatalf("Failed to export game: %v", err)
+	}
+	for _, expected := range []string{
+		fmt.Sprintf("[White \"%s\"]\n", game.WhitePlayer), "[Result \"1-0\"]\n", "[GameType \"Gipf\"]\n",
+		"[Termination \"Game won by white\"]\n", "\n\n1. a\n2... b c\n1-0\n",
+	} {
+		if !strings.Contains(record, expected) {
+			t.Fatalf("Expected %q in the record:\n%s", expected, record)
+		}
+	}
+
+	// Test 2: Boardspace records can be downloaded
+	resp, err := http.Get(fmt.Sprintf("http://localhost:1234/game/%d/export?format=boardspace", game.Id))
+	if err != nil {
+		t.Fatalf("Failed to export game: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, expected := range []string{"GM[Gipf]VV[1]\n", "; P0[1 a]\n; P1[2 b c]\n", "RE[Game won by white]\n"} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("Expected %q in the record:\n%s", expected, body)
+		}
+	}
+}
+
+func TestExportUserGames(t *testing.T) {
+	user := mustRegisterAndAuthenticateRandomUser(t)
+	game1 := mustCreateGame(t, user, true, true)
+	game2 := mustCreateGame(t, user, false, false)
+
+	body := postObject(t, "http://localhost:1234/game/export/byuser", map[string]interface{}{"token": user.Token, "format": "boardspace"})
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("Expected a zip archive, got %q: %v", body, err)
+	}
+	var names []string
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+	sort.Strings(names)
+	expected := []string{fmt.Sprintf("game-%d.sgf", game1.Id), fmt.Sprintf("game-%d.sgf", game2.Id)}
+	sort.Strings(expected)
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected files %v, got %v", expected, names)
+	}
+}
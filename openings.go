@@ -0,0 +1,214 @@
+// openings.go maintains the opening explorer: an index of the actions played from each sequence of opening actions
+// of every game type, with the results of the games they were played in. The index is updated as actions are made
+// and games finish, and covers the first openingDepth actions of public games that were not forked from others.
+
+package gameserver
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+)
+
+// openingDepth is the number of actions of each game that are indexed.
+const openingDepth = 20
+
+// OpeningMove is an action played after a sequence of opening actions, with the results of the games it was played in.
+type OpeningMove struct {
+	Action    string `json:"action"`
+	Games     int    `json:"games"`
+	WhiteWins int    `json:"white_wins"`
+	Draws     int    `json:"draws"`
+	BlackWins int    `json:"black_wins"`
+	// The percentages are relative to the games that ended with a win or a draw.
+	WhitePercent float64 `json:"white_percent"`
+	DrawPercent  float64 `json:"draw_percent"`
+	BlackPercent float64 `json:"black_percent"`
+}
+
+// openingKey identifies a sequence of actions in the index.
+func openingKey(actions []string) string {
+	h := sha256.New()
+	for _, action := range actions {
+		binary.Write(h, binary.BigEndian, uint32(len(action)))
+		h.Write([]byte(action))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// indexedActions returns the type of the game and its actions covered by the index, or no actions if the game
+// is not indexed.
+func indexedActions(tx *sql.Tx, gameID int) (string, []string, error) {
+	var gameType string
+	var indexed bool
+	err := tx.QueryRow("SELECT type, viewer_token = '' AND from_game_id = 0 FROM games WHERE id = ?", gameID).
+		Scan(&gameType, &indexed)
+	if err != nil || !indexed {
+		return gameType, nil, err
+	}
+	rows, err := tx.Query("SELECT action FROM actions WHERE game_id = ? AND action_num <= ? ORDER BY action_num",
+		gameID, openingDepth)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+	var actions []string
+	for rows.Next() {
+		var action string
+		if err := rows.Scan(&action); err != nil {
+			return "", nil, err
+		}
+		actions = append(actions, action)
+	}
+	return gameType, actions, rows.Err()
+}
+
+// indexAction adds the action actionNum of the game, which has just been made, to the index.
+func indexAction(tx *sql.Tx, gameID, actionNum int) error {
+	if actionNum > openingDepth {
+		return nil
+	}
+	gameType, actions, err := indexedActions(tx, gameID)
+	if err != nil || len(actions) < actionNum {
+		return err
+	}
+	return addOpeningMove(tx, gameType, actions[:actionNum])
+}
+
+// addOpeningMove counts a game in which the last of the actions was played after the others.
+func addOpeningMove(tx *sql.Tx, gameType string, actions []string) error {
+	_, err := tx.Exec(`
+		INSERT INTO openings(game_type, prefix, action, games) VALUES(?, ?, ?, 1)
+		ON CONFLICT(game_type, prefix, action) DO UPDATE SET games = games + 1
+	`, gameType, openingKey(actions[:len(actions)-1]), actions[len(actions)-1])
+	return err
+}
+
+// indexResult adds the result of a game that has just finished to the index.
+func indexResult(tx *sql.Tx, gameID int, result string) error {
+	var column string
+	switch resultToken(&Game{GameOver: true, GameResult: result}) {
+	case "1-0":
+		column = "white_wins"
+	case "0-1":
+		column = "black_wins"
+	case "1/2-1/2":
+		column = "draws"
+	default:
+		return nil
+	}
+	gameType, actions, err := indexedActions(tx, gameID)
+	if err != nil {
+		return err
+	}
+	for i, action := range actions {
+		_, err := tx.Exec("UPDATE openings SET "+column+" = "+column+" + 1 WHERE game_type = ? AND prefix = ? AND action = ?",
+			gameType, openingKey(actions[:i]), action)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexOpenings is the migration indexing the games played before the index existed. It rebuilds the index from
+// scratch, so that it can run on databases whose index is already up to date.
+func indexOpenings(tx *sql.Tx) error {
+	if _, err := tx.Exec("DELETE FROM openings"); err != nil {
+		return err
+	}
+	rows, err := tx.Query("SELECT id, game_over, game_result FROM games ORDER BY id")
+	if err != nil {
+		return err
+	}
+	type finishedGame struct {
+		id       int
+		gameOver bool
+		result   string
+	}
+	var games []finishedGame
+	for rows.Next() {
+		var game finishedGame
+		if err := rows.Scan(&game.id, &game.gameOver, &game.result); err != nil {
+			rows.Close()
+			return err
+		}
+		games = append(games, game)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	for _, game := range games {
+		if err := indexGame(tx, game.id, game.gameOver, game.result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexGame adds all the actions of the game, and its result if it is over, to the index.
+func indexGame(tx *sql.Tx, gameID int, gameOver bool, result string) error {
+	gameType, actions, err := indexedActions(tx, gameID)
+	if err != nil {
+		return err
+	}
+	for i := range actions {
+		if err := addOpeningMove(tx, gameType, actions[:i+1]); err != nil {
+			return err
+		}
+	}
+	if gameOver {
+		return indexResult(tx, gameID, result)
+	}
+	return nil
+}
+
+// GetOpeningMoves returns the actions played after the given actions in games of the given type, the most
+// played first.
+func GetOpeningMoves(gameType string, actions []string) ([]OpeningMove, error) {
+	rows, err := db.Query(`
+		SELECT action, games, white_wins, draws, black_wins FROM openings
+		WHERE game_type = ? AND prefix = ?
+		ORDER BY games DESC, action
+	`, gameType, openingKey(actions))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	moves := []OpeningMove{}
+	for rows.Next() {
+		var move OpeningMove
+		if err := rows.Scan(&move.Action, &move.Games, &move.WhiteWins, &move.Draws, &move.BlackWins); err != nil {
+			return nil, err
+		}
+		if decided := move.WhiteWins + move.Draws + move.BlackWins; decided > 0 {
+			move.WhitePercent = 100 * float64(move.WhiteWins) / float64(decided)
+			move.DrawPercent = 100 * float64(move.Draws) / float64(decided)
+			move.BlackPercent = 100 * float64(move.BlackWins) / float64(decided)
+		}
+		moves = append(moves, move)
+	}
+	return moves, rows.Err()
+}
+
+// openingsHandler serves GET prefix/openings?type=...&action=...&action=..., which returns the actions played after
+// the given sequence of actions in games of the given type.
+func openingsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("type") == "" {
+		sendError(w, serverError("missing game type", nil))
+		return
+	}
+	moves, err := GetOpeningMoves(query.Get("type"), query["action"])
+	if err != nil {
+		sendError(w, serverError("cannot get opening moves", err))
+		return
+	}
+	writeJSONResponse(w, struct {
+		Type    string        `json:"type"`
+		Actions []string      `json:"actions"`
+		Moves   []OpeningMove `json:"moves"`
+	}{query.Get("type"), append([]string{}, query["action"]...), moves})
+}
@@ -0,0 +1,107 @@
+package gameserver_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/vkryukov/gameserver"
+)
+
+type openingsResponse struct {
+	Actions []string                 `json:"actions"`
+	Moves   []gameserver.OpeningMove `json:"moves"`
+}
+
+func mustGetOpenings(t *testing.T, gameType string, actions ...string) openingsResponse {
+	query := url.Values{"type": {gameType}, "action": actions}
+	resp, err := http.Get("http://localhost:1234/game/openings?" + query.Encode())
+	if err != nil {
+		t.Fatalf("Failed to get openings: %v", err)
+	}
+	defer resp.Body.Close()
+	var openings openingsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&openings); err != nil {
+		t.Fatalf("Failed to decode openings: %v", err)
+	}
+	return openings
+}
+
+func TestOpeningExplorer(t *testing.T) {
+	// A first action no other test plays keeps the counts of this test apart.
+	first := fmt.Sprintf("opening %s", gameserver.GenerateToken())
+
+	// Test 1: actions are indexed as they are made, and results when games finish
+	mustPlayGame(t, []string{first, "b", "c"}, "Game won by white")
+	mustPlayGame(t, []string{first, "b"}, "Game won by black")
+	mustPlayGame(t, []string{first, "b"}, "")
+	draw := mustPlayGame(t, []string{first, "d"}, "Draw")
+	openings := mustGetOpenings(t, "Gipf", first)
+	if len(openings.Actions) != 1 || len(openings.Moves) != 2 {
+		t.Fatalf("Unexpected openings: %s", mustPrettyPrint(t, openings))
+	}
+	b, d := openings.Moves[0], openings.Moves[1]
+	if b.Action != "b" || b.Games != 3 || b.WhiteWins != 1 || b.BlackWins != 1 || b.Draws != 0 || b.WhitePercent != 50 {
+		t.Fatalf("Unexpected statistics of b: %+v", b)
+	}
+	if d.Action != "d" || d.Games != 1 || d.Draws != 1 || d.DrawPercent != 100 {
+		t.Fatalf("Unexpected statistics of d: %+v", d)
+	}
+	openings = mustGetOpenings(t, "Gipf")
+	found := false
+	for _, move := range openings.Moves {
+		if move.Action == first {
+			found = move.Games == 4 && move.WhiteWins == 1 && move.BlackWins == 1 && move.Draws == 1
+		}
+	}
+	if !found {
+		t.Fatalf("Expected %q among the first moves with 4 games: %s", first, mustPrettyPrint(t, openings))
+	}
+
+	// Test 2: imported games are indexed, while forked and private games are not
+	mustImportGame(t, fmt.Sprintf("(;\nGM[Gipf]\n; P0[1 %s]\n; P1[2 e]\nRE[Game won by white]\n)\n", first), gameserver.FormatBoardspace)
+	user := mustRegisterAndAuthenticateRandomUser(t)
+	fork, err := gameserver.CreateGame(&gameserver.Game{BlackPlayer: user.ScreenName, BlackToken: user.Token, Public: true,
+		FromGame: draw.Id, FromAction: 1})
+	if err != nil {
+		t.Fatalf("Failed to fork game: %v", err)
+	}
+	resp := postObject(t, fmt.Sprintf("http://localhost:1234/game/%d/actions", fork.Id),
+		map[string]interface{}{"token": user.Token, "action_num": 2, "action": "f"})
+	if isErrorResponse(resp, "") {
+		t.Fatalf("Failed to make action: %s", resp)
+	}
+	private := mustCreateGame(t, user, true, false)
+	resp = postObject(t, fmt.Sprintf("http://localhost:1234/game/%d/actions", private.Id),
+		map[string]interface{}{"token": user.Token, "action_num": 1, "action": first})
+	if isErrorResponse(resp, "") {
+		t.Fatalf("Failed to make action: %s", resp)
+	}
+	openings = mustGetOpenings(t, "Gipf", first)
+	if len(openings.Moves) != 3 || openings.Moves[2].Action != "e" || openings.Moves[2].WhiteWins != 1 {
+		t.Fatalf("Unexpected openings: %s", mustPrettyPrint(t, openings))
+	}
+
+	// Test 3: the result of a game is counted once, even if the end of the game is sent again
+	second := fmt.Sprintf("opening %s", gameserver.GenerateToken())
+	game := mustPlayGame(t, []string{second}, "Game won by white")
+	conn := mustDialWS(t)
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: game.WhiteToken, Type: "Join"})
+	mustReadWSMessageOfType(t, conn, "GameJoined")
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: game.WhiteToken, Type: "GameOver", Message: "Game won by black"})
+	if resp := mustReadWSMessageOfType(t, conn, "Error"); resp.ErrorCode != gameserver.ErrorGameOver {
+		t.Fatalf("Expected the second end of the game to be refused, got %s", mustPrettyPrint(t, resp))
+	}
+	openings = mustGetOpenings(t, "Gipf")
+	found = false
+	for _, move := range openings.Moves {
+		if move.Action == second {
+			found = move.Games == 1 && move.WhiteWins == 1 && move.BlackWins == 0 && move.Draws == 0
+		}
+	}
+	if !found {
+		t.Fatalf("Expected %q among the first moves with a single win of white: %s", second, mustPrettyPrint(t, openings))
+	}
+}
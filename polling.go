@@ -0,0 +1,136 @@
+// polling.go lets clients that cannot use WebSockets, such as simple bots or users behind restrictive firewalls,
+// play over plain HTTP. GET prefix/{id}/actions returns the actions made after a given one, optionally waiting for
+// new actions to be made, and POST prefix/{id}/actions makes an action, which is broadcast to the WebSocket
+// connections of the game like any other.
+
+package gameserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxPollWait is the longest a client may wait for new actions in a single request.
+const maxPollWait = time.Minute
+
+func gameActionsHandler(w http.ResponseWriter, r *http.Request, gameID int) {
+	switch r.Method {
+	case http.MethodGet:
+		pollActionsHandler(w, r, gameID)
+	case http.MethodPost:
+		postActionHandler(w, r, gameID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// pollActionsHandler returns the actions made after the one given by the "since" query parameter. If there are none,
+// it waits for up to "wait" seconds for a new action or the end of the game. Private games require a token. With a
+// player's token, the player is seen and, while waiting, connected to the game.
+func pollActionsHandler(w http.ResponseWriter, r *http.Request, gameID int) {
+	query := r.URL.Query()
+	since, _ := strconv.Atoi(query.Get("since"))
+	waitSeconds, _ := strconv.Atoi(query.Get("wait"))
+	wait := min(time.Duration(waitSeconds)*time.Second, maxPollWait)
+
+	game, err := GetGameWithId(gameID)
+	if err != nil {
+		sendError(w, serverError("cannot find game", err))
+		return
+	}
+	if !canWatch(r, game) {
+		sendError(w, serverError("invalid token", nil))
+		return
+	}
+
+	seat, _ := validateGameToken(gameID, Token(query.Get("token")))
+	if seat != WhitePlayer && seat != BlackPlayer {
+		seat = Viewer
+	}
+
+	var conn Conn
+	if wait > 0 {
+		// Subscribe before reading the actions, so that an action made in between is not missed.
+		conn = newStreamConn()
+		defer conn.Close()
+		addConnection(gameID, conn, seat)
+		defer removeConnection(conn)
+		playerConnected(conn, gameID, seat)
+	} else {
+		updateLastSeen(gameID, seat)
+	}
+	timeout := time.After(wait)
+	for {
+		actions, err := getActionsSince(gameID, since)
+		if err != nil {
+			sendError(w, serverError("cannot get actions", err))
+			return
+		}
+		game, err = GetGameWithId(gameID)
+		if err != nil {
+			sendError(w, serverError("cannot find game", err))
+			return
+		}
+		if len(actions) > 0 || game.GameOver || wait <= 0 || !waitForActions(r, conn, timeout) {
+			writeJSONResponse(w, map[string]interface{}{
+				"actions":     actions,
+				"game_over":   game.GameOver,
+				"game_result": game.GameResult,
+			})
+			return
+		}
+	}
+}
+
+// waitForActions waits until an action or the end of the game is broadcast to the connection. It returns false
+// if it stopped waiting for any other reason.
+func waitForActions(r *http.Request, conn Conn, timeout <-chan time.Time) bool {
+	for {
+		select {
+		case message := <-conn.messages:
+			if message.Type == "Action" || message.Type == "GameOver" {
+				return true
+			}
+		case <-timeout:
+			return false
+		case <-conn.closed:
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
+
+// postActionHandler makes an action in the game, with the same checks as actions sent over a WebSocket.
+func postActionHandler(w http.ResponseWriter, r *http.Request, gameID int) {
+	var request struct {
+		Token Token `json:"token"`
+		Action
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendCodedError(w, newCodedError(ErrorInvalidMessage, "invalid action: %v", err))
+		return
+	}
+	player, _ := validateGameToken(gameID, request.Token)
+	if player == InvalidPlayer {
+		sendCodedError(w, newCodedError(ErrorNotAllowed, "invalid game id or token"))
+		return
+	}
+	updateLastSeen(gameID, player)
+	duplicate, err := appendAction(gameID, player, request.Action)
+	if err != nil {
+		sendCodedError(w, err)
+		return
+	}
+	if !duplicate {
+		message, err := newJSONMessage(gameID, "Action", request.Action)
+		if err != nil {
+			sendCodedError(w, err)
+			return
+		}
+		broadcast(gameID, message)
+	}
+	writeJSONResponse(w, map[string]interface{}{"action_num": request.ActionNum, "duplicate": duplicate})
+}
@@ -0,0 +1,121 @@
+package gameserver_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/vkryukov/gameserver"
+)
+
+type polledActions struct {
+	Actions    []gameserver.Action `json:"actions"`
+	GameOver   bool                `json:"game_over"`
+	GameResult string              `json:"game_result"`
+}
+
+func mustPollActions(t *testing.T, gameID int, since int, wait int) *polledActions {
+	resp, err := http.Get(fmt.Sprintf("http://localhost:1234/game/%d/actions?since=%d&wait=%d", gameID, since, wait))
+	if err != nil {
+		t.Errorf("Failed to poll actions: %v", err)
+		return nil
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	var polled polledActions
+	if err := json.Unmarshal(body, &polled); err != nil {
+		t.Errorf("Failed to unmarshal response %q: %v", body, err)
+		return nil
+	}
+	return &polled
+}
+
+func TestHTTPActions(t *testing.T) {
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user1, true, true)
+	mustJoinGame(t, user2, game)
+	url := fmt.Sprintf("http://localhost:1234/game/%d/actions", game.Id)
+	conn := mustDialWS(t)
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user2.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, conn, "GameJoined")
+
+	// Test 1: a new game has no actions
+	if polled := mustPollActions(t, game.Id, 0, 0); polled == nil || len(polled.Actions) != 0 || polled.GameOver {
+		t.Fatalf("Unexpected actions: %+v", polled)
+	}
+
+	// Test 2: actions made over HTTP are broadcast to WebSocket connections
+	var resp struct {
+		ActionNum int                  `json:"action_num"`
+		Error     string               `json:"error"`
+		ErrorCode gameserver.ErrorCode `json:"error_code"`
+	}
+	mustDecodeRequestWithObject(t, url, map[string]interface{}{"token": user1.Token, "action_num": 1, "action": "a"}, &resp)
+	if resp.Error != "" || resp.ActionNum != 1 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	var action gameserver.Action
+	if err := json.Unmarshal([]byte(mustReadWSMessageOfType(t, conn, "Action").Message), &action); err != nil || action.Action != "a" {
+		t.Fatalf("Unexpected action broadcast: %v %v", action, err)
+	}
+
+	// Test 3: actions made over HTTP are checked like any other
+	resp.Error = ""
+	mustDecodeRequestWithObject(t, url, map[string]interface{}{"token": user1.Token, "action_num": 1, "action": "b"}, &resp)
+	if resp.ErrorCode != gameserver.ErrorConflict {
+		t.Fatalf("Expected a conflict, got %+v", resp)
+	}
+	resp.Error = ""
+	mustDecodeRequestWithObject(t, url, map[string]interface{}{"token": game.ViewerToken, "action_num": 2, "action": "b"}, &resp)
+	if resp.Error == "" {
+		t.Fatalf("Expected an error for a missing token, got %+v", resp)
+	}
+
+	// Test 4: polling waits for the next action
+	polledCh := make(chan *polledActions, 1)
+	go func() { polledCh <- mustPollActions(t, game.Id, 1, 10) }()
+	time.Sleep(100 * time.Millisecond)
+	mustDecodeRequestWithObject(t, url, map[string]interface{}{"token": user2.Token, "action_num": 2, "action": "b"}, &resp)
+	select {
+	case polled := <-polledCh:
+		if polled == nil || len(polled.Actions) != 1 || polled.Actions[0].Action != "b" {
+			t.Fatalf("Unexpected actions: %+v", polled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Polling did not return after a new action")
+	}
+
+	// Test 5: polling gives up after the wait
+	start := time.Now()
+	if polled := mustPollActions(t, game.Id, 2, 1); polled == nil || len(polled.Actions) != 0 || time.Since(start) < time.Second {
+		t.Fatalf("Unexpected actions after %v: %+v", time.Since(start), polled)
+	}
+
+	// Test 6: players who only use HTTP are seen when they make actions, and connected while they wait
+	var presence gameserver.Presence
+	presenceURL := "http://localhost:1234/game/presence"
+	mustDecodeRequestWithObject(t, presenceURL, map[string]interface{}{"id": game.Id, "token": user1.Token}, &presence)
+	if presence.WhiteLastSeen == 0 || presence.White {
+		t.Fatalf("Unexpected presence of a player making actions over HTTP: %+v", presence)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Get(fmt.Sprintf("%s?since=2&wait=10&token=%s", url, user1.Token))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	mustReadWSMessageOfType(t, conn, "PlayerConnected")
+	mustDecodeRequestWithObject(t, presenceURL, map[string]interface{}{"id": game.Id, "token": user1.Token}, &presence)
+	if !presence.White {
+		t.Fatalf("Expected a waiting player to be connected: %+v", presence)
+	}
+	mustDecodeRequestWithObject(t, url, map[string]interface{}{"token": user2.Token, "action_num": 3, "action": "c"}, &resp)
+	<-done
+	mustReadWSMessageOfType(t, conn, "PlayerDisconnected")
+}
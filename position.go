@@ -0,0 +1,184 @@
+// position.go computes the state of a game after any of its actions with the rules engine of the game type. To avoid
+// replaying long games from the start, the states after every snapshotInterval actions are cached for the most
+// recently used games, up to snapshotStates states in all.
+
+package gameserver
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	// snapshotInterval is the number of actions between cached states of a game.
+	snapshotInterval = 20
+	// snapshotGames is the maximum number of games whose states are cached.
+	snapshotGames = 256
+	// snapshotStates is the maximum number of cached states of all games.
+	snapshotStates = 4096
+)
+
+type gameSnapshots struct {
+	gameID int
+	// states maps action numbers, which are multiples of snapshotInterval, to the state after the action.
+	states map[int]GameState
+}
+
+var (
+	snapshots   = make(map[int]*list.Element)
+	snapshotLRU = list.New()
+	// numSnapshots is the number of states cached for all games.
+	numSnapshots int
+	snapshotsMu  sync.Mutex
+)
+
+// getSnapshot returns the latest cached state of the game after at most actionNum actions, and the number of
+// actions it is after. It returns a nil state if there is none.
+func getSnapshot(gameID int, actionNum int) (GameState, int) {
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	element := snapshots[gameID]
+	if element == nil {
+		return nil, 0
+	}
+	snapshotLRU.MoveToFront(element)
+	states := element.Value.(*gameSnapshots).states
+	for num := actionNum - actionNum%snapshotInterval; num > 0; num -= snapshotInterval {
+		if state := states[num]; state != nil {
+			return state, num
+		}
+	}
+	return nil, 0
+}
+
+func saveSnapshot(gameID int, actionNum int, state GameState) {
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	element := snapshots[gameID]
+	if element == nil {
+		element = snapshotLRU.PushFront(&gameSnapshots{gameID, make(map[int]GameState)})
+		snapshots[gameID] = element
+	}
+	snapshotLRU.MoveToFront(element)
+	states := element.Value.(*gameSnapshots).states
+	if states[actionNum] == nil {
+		numSnapshots++
+	}
+	states[actionNum] = state
+	for snapshotLRU.Len() > 1 && (snapshotLRU.Len() > snapshotGames || numSnapshots > snapshotStates) {
+		removeSnapshots(snapshotLRU.Back())
+	}
+	// A single game may have more states than fit in the cache: only its earliest ones are kept.
+	if numSnapshots > snapshotStates {
+		delete(states, actionNum)
+		numSnapshots--
+	}
+}
+
+// forgetSnapshots removes the cached states of a game that has been deleted.
+func forgetSnapshots(gameID int) {
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	if element := snapshots[gameID]; element != nil {
+		removeSnapshots(element)
+	}
+}
+
+// removeSnapshots removes the cached states of a game. The caller must hold snapshotsMu.
+func removeSnapshots(element *list.Element) {
+	game := element.Value.(*gameSnapshots)
+	snapshotLRU.Remove(element)
+	delete(snapshots, game.gameID)
+	numSnapshots -= len(game.states)
+}
+
+// GetPosition returns the state of the game after the given number of actions.
+func GetPosition(gameID int, actionNum int) (GameState, error) {
+	var gameType string
+	var numActions int
+	err := db.QueryRow("SELECT type, (SELECT COUNT(*) FROM actions WHERE game_id = games.id) FROM games WHERE id = ?", gameID).
+		Scan(&gameType, &numActions)
+	if err != nil {
+		return nil, err
+	}
+	engine := getRulesEngine(gameType)
+	if engine == nil {
+		return nil, newCodedError(ErrorUnavailable, "no rules engine is registered for %s", gameType)
+	}
+	if actionNum < 0 || actionNum > numActions {
+		return nil, newCodedError(ErrorInvalidActionNumber, "invalid action number %d: the game has %d actions", actionNum, numActions)
+	}
+
+	state, from := getSnapshot(gameID, actionNum)
+	if state == nil {
+		state = engine.InitialState()
+	}
+	rows, err := db.Query("SELECT action_num, action FROM actions WHERE game_id = ? AND action_num > ? AND action_num <= ? ORDER BY action_num",
+		gameID, from, actionNum)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var num int
+		var action string
+		if err := rows.Scan(&num, &action); err != nil {
+			return nil, err
+		}
+		state, err = state.Apply(action)
+		if err != nil {
+			return nil, fmt.Errorf("action %d (%s) is not legal: %v", num, action, err)
+		}
+		if num%snapshotInterval == 0 {
+			saveSnapshot(gameID, num, state)
+		}
+	}
+	return state, rows.Err()
+}
+
+// positionHandler serves GET prefix/{id}/position, which returns the state of the game after the number of actions
+// given by the "action" query parameter, or after the last action if there is none. Private games require a token
+// in the "token" query parameter.
+func positionHandler(w http.ResponseWriter, r *http.Request, gameID int) {
+	game, err := GetGameWithId(gameID)
+	if err != nil {
+		sendError(w, serverError("cannot find game", err))
+		return
+	}
+	if !canWatch(r, game) {
+		sendError(w, serverError("invalid token", nil))
+		return
+	}
+	actionNum, err := requestedActionNum(r, game)
+	if err != nil {
+		sendCodedError(w, err)
+		return
+	}
+	state, err := GetPosition(gameID, actionNum)
+	if err != nil {
+		sendCodedError(w, err)
+		return
+	}
+	writeJSONResponse(w, map[string]interface{}{
+		"game_id":    gameID,
+		"action_num": actionNum,
+		"state":      state,
+	})
+}
+
+// requestedActionNum returns the action number in the "action" query parameter, or the number of actions of the game
+// if there is none.
+func requestedActionNum(r *http.Request, game *Game) (int, error) {
+	param := r.URL.Query().Get("action")
+	if param == "" {
+		return game.NumActions, nil
+	}
+	actionNum, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, newCodedError(ErrorInvalidActionNumber, "invalid action number %q", param)
+	}
+	return actionNum, nil
+}
@@ -0,0 +1,48 @@
+package gameserver_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/vkryukov/gameserver"
+)
+
+func TestGamePosition(t *testing.T) {
+	var record strings.Builder
+	record.WriteString("(;\nGM[Counting]VV[1]\n")
+	for i := 1; i <= 45; i++ {
+		fmt.Fprintf(&record, "; P%d[%d %d]\n", (i+1)%2, i, i)
+	}
+	record.WriteString("RE[Draw]\n)\n")
+	game := mustImportGame(t, record.String(), gameserver.FormatBoardspace)
+
+	// Test 1: positions are computed with the rules engine, from cached snapshots when possible
+	for _, num := range []int{0, 45, 20, 41, 45} {
+		state, err := gameserver.GetPosition(game.Id, num)
+		if err != nil || fmt.Sprint(state) != fmt.Sprint(num) {
+			t.Fatalf("Expected the state after action %d, got %v (%v)", num, state, err)
+		}
+	}
+
+	// Test 2: positions can be fetched over HTTP
+	var resp struct {
+		ActionNum int                  `json:"action_num"`
+		State     int                  `json:"state"`
+		ErrorCode gameserver.ErrorCode `json:"error_code"`
+	}
+	mustDecodeRequestWithObject(t, fmt.Sprintf("http://localhost:1234/game/%d/position?action=30", game.Id), nil, &resp)
+	if resp.ActionNum != 30 || resp.State != 30 {
+		t.Fatalf("Unexpected position: %+v", resp)
+	}
+	mustDecodeRequestWithObject(t, fmt.Sprintf("http://localhost:1234/game/%d/position?action=46", game.Id), nil, &resp)
+	if resp.ErrorCode != gameserver.ErrorInvalidActionNumber {
+		t.Fatalf("Expected an invalid action number, got %+v", resp)
+	}
+
+	// Test 3: positions need a rules engine
+	game = mustPlayGame(t, []string{"a"}, "")
+	if _, err := gameserver.GetPosition(game.Id, 1); err == nil || !strings.Contains(err.Error(), "no rules engine") {
+		t.Fatalf("Expected a missing rules engine error, got %v", err)
+	}
+}
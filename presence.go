@@ -0,0 +1,124 @@
+// presence.go keeps track of which players are connected to their games, announces changes to the other
+// connections of the game, and records when each user was last seen.
+
+package gameserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Presence describes who is currently connected to a game.
+type Presence struct {
+	White   bool `json:"white"`
+	Black   bool `json:"black"`
+	Viewers int  `json:"viewers"`
+	// WhiteLastSeen and BlackLastSeen are the times (in milliseconds since the epoch) when the players were last
+	// connected to any of their games, or 0 if never.
+	WhiteLastSeen int `json:"white_last_seen"`
+	BlackLastSeen int `json:"black_last_seen"`
+}
+
+func getPresence(gameID int) (*Presence, error) {
+	var presence Presence
+	var whiteLastSeen, blackLastSeen float64
+	err := db.QueryRow(`
+		SELECT COALESCE(u1.last_seen, 0), COALESCE(u2.last_seen, 0)
+		FROM games g
+		LEFT JOIN users u1 ON g.white_user_id = u1.id
+		LEFT JOIN users u2 ON g.black_user_id = u2.id
+		WHERE g.id = ?
+	`, gameID).Scan(&whiteLastSeen, &blackLastSeen)
+	if err != nil {
+		return nil, err
+	}
+	presence.WhiteLastSeen = int(whiteLastSeen)
+	presence.BlackLastSeen = int(blackLastSeen)
+
+	withHub(gameID, false, func(h *gameHub) {
+		for _, conn := range h.conns {
+			switch conn.player {
+			case WhitePlayer:
+				presence.White = true
+			case BlackPlayer:
+				presence.Black = true
+			case Viewer:
+				presence.Viewers++
+			}
+		}
+	})
+	return &presence, nil
+}
+
+// updateLastSeen records the current time as the last time the given player of the game was seen, both in the game
+// and for the user playing it.
+func updateLastSeen(gameID int, player PlayerType) {
+	if player != WhitePlayer && player != BlackPlayer {
+		return
+	}
+	color := player.String()
+	_, err := db.Exec(`
+		UPDATE users SET last_seen = ((julianday('now') - 2440587.5)*86400000)
+		WHERE id = (SELECT `+color+`_user_id FROM games WHERE id = ?)
+	`, gameID)
+	if err == nil {
+		_, err = db.Exec("UPDATE games SET "+color+"_last_seen = ((julianday('now') - 2440587.5)*86400000) WHERE id = ?", gameID)
+	}
+	if err != nil {
+		log.Printf("Error updating last seen time for %s in game %d: %v", player, gameID, err)
+	}
+}
+
+// playerConnected announces to the other connections of the game that the player is now connected.
+func playerConnected(conn Conn, gameID int, player PlayerType) {
+	if player != WhitePlayer && player != BlackPlayer {
+		return
+	}
+	updateLastSeen(gameID, player)
+	playerReturned(gameID, player)
+	message, err := newJSONMessage(gameID, "PlayerConnected", map[string]string{"player": player.String()})
+	if err == nil {
+		broadcastExcept(gameID, conn, message)
+	}
+}
+
+// removeConnection unregisters the connection from all the games it has joined, and announces the players
+// who no longer have any connection to their game.
+func removeConnection(conn Conn) {
+	for _, gameID := range conn.joinedGames() {
+		player, stillConnected := unregisterConnection(gameID, conn)
+		if (player != WhitePlayer && player != BlackPlayer) || stillConnected {
+			continue
+		}
+		updateLastSeen(gameID, player)
+		playerAbsent(gameID, player)
+		message, err := newJSONMessage(gameID, "PlayerDisconnected", map[string]string{"player": player.String()})
+		if err == nil {
+			broadcast(gameID, message)
+		}
+	}
+}
+
+func presenceHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Id    int   `json:"id"`
+		Token Token `json:"token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		sendError(w, serverError("incorrect request", err))
+		return
+	}
+	player, _ := validateGameToken(request.Id, request.Token)
+	if player == InvalidPlayer {
+		sendError(w, serverError("invalid token", nil))
+		return
+	}
+	presence, err := getPresence(request.Id)
+	if err != nil {
+		sendError(w, serverError("cannot get presence", err))
+		return
+	}
+	writeJSONResponse(w, presence)
+}
@@ -0,0 +1,248 @@
+// protocol.go implements the wire formats of WebSocket messages.
+//
+// In protocol v1, the content of a message is a string, which for most message types holds JSON produced by
+// newJSONMessage, so it is encoded twice. In protocol v2, the content is sent as a JSON value in the "payload"
+// field instead: the JSON content of WebSocketMessage.Payload as is, and any other content as a JSON string. Clients
+// choose v2 with the "gameserver.v2" subprotocol or the "protocol=2" query parameter when connecting; everyone else
+// gets v1.
+//
+// The MessagePack protocol carries the same messages as v2, encoded with MessagePack in binary WebSocket messages,
+// with the payload sent as a MessagePack value. Clients choose it with the "gameserver.msgpack" subprotocol or the
+// "protocol=msgpack" query parameter. Internally, the server always works with WebSocketMessage.
+
+package gameserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type protocol int
+
+const (
+	protocolV1      protocol = 1
+	protocolV2      protocol = 2
+	protocolMsgPack protocol = 3
+)
+
+const (
+	subprotocolV1      = "gameserver.v1"
+	subprotocolV2      = "gameserver.v2"
+	subprotocolMsgPack = "gameserver.msgpack"
+)
+
+// WebSocketMessageV2 is the wire format of messages in protocol v2.
+type WebSocketMessageV2 struct {
+	GameID    int             `json:"game_id"`
+	Token     Token           `json:"token"`
+	Type      string          `json:"message_type,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Seq       int             `json:"seq,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	ErrorCode ErrorCode       `json:"error_code,omitempty"`
+}
+
+// WebSocketMessageMsgPack is the wire format of messages in the MessagePack protocol.
+type WebSocketMessageMsgPack struct {
+	GameID    int                `msgpack:"game_id"`
+	Token     Token              `msgpack:"token"`
+	Type      string             `msgpack:"message_type,omitempty"`
+	Payload   msgpack.RawMessage `msgpack:"payload,omitempty"`
+	Seq       int                `msgpack:"seq,omitempty"`
+	RequestID string             `msgpack:"request_id,omitempty"`
+	ErrorCode ErrorCode          `msgpack:"error_code,omitempty"`
+}
+
+// negotiateProtocol returns the protocol requested by the client, given the subprotocol selected during the upgrade.
+func negotiateProtocol(r *http.Request, subprotocol string) protocol {
+	switch subprotocol {
+	case subprotocolV1:
+		return protocolV1
+	case subprotocolV2:
+		return protocolV2
+	case subprotocolMsgPack:
+		return protocolMsgPack
+	}
+	switch r.URL.Query().Get("protocol") {
+	case "2":
+		return protocolV2
+	case "msgpack":
+		return protocolMsgPack
+	}
+	return protocolV1
+}
+
+// messageType returns the type of WebSocket messages used by the protocol.
+func (p protocol) messageType() int {
+	if p == protocolMsgPack {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+func (p protocol) encode(message WebSocketMessage) (int, []byte, error) {
+	switch p {
+	case protocolV1:
+		data, err := json.Marshal(message)
+		return websocket.TextMessage, data, err
+	case protocolMsgPack:
+		payload, err := toMsgPackPayload(message)
+		if err != nil {
+			return 0, nil, err
+		}
+		data, err := msgpack.Marshal(WebSocketMessageMsgPack{
+			GameID:    message.GameID,
+			Token:     message.Token,
+			Type:      message.Type,
+			Payload:   payload,
+			Seq:       message.Seq,
+			RequestID: message.RequestID,
+			ErrorCode: message.ErrorCode,
+		})
+		return websocket.BinaryMessage, data, err
+	}
+	data, err := json.Marshal(WebSocketMessageV2{
+		GameID:    message.GameID,
+		Token:     message.Token,
+		Type:      message.Type,
+		Payload:   toPayload(message),
+		Seq:       message.Seq,
+		RequestID: message.RequestID,
+		ErrorCode: message.ErrorCode,
+	})
+	return websocket.TextMessage, data, err
+}
+
+func (p protocol) decode(data []byte) (WebSocketMessage, error) {
+	var message WebSocketMessage
+	switch p {
+	case protocolV1:
+		err := json.Unmarshal(data, &message)
+		return message, err
+	case protocolMsgPack:
+		var messageMsgPack WebSocketMessageMsgPack
+		if err := msgpack.Unmarshal(data, &messageMsgPack); err != nil {
+			return message, err
+		}
+		content, payload, err := fromMsgPackPayload(messageMsgPack.Payload)
+		if err != nil {
+			return message, err
+		}
+		return WebSocketMessage{
+			GameID:    messageMsgPack.GameID,
+			Token:     messageMsgPack.Token,
+			Type:      messageMsgPack.Type,
+			Message:   content,
+			Payload:   payload,
+			Seq:       messageMsgPack.Seq,
+			RequestID: messageMsgPack.RequestID,
+		}, nil
+	}
+	var messageV2 WebSocketMessageV2
+	if err := json.Unmarshal(data, &messageV2); err != nil {
+		return message, err
+	}
+	content, payload, err := fromPayload(messageV2.Payload)
+	if err != nil {
+		return message, err
+	}
+	return WebSocketMessage{
+		GameID:    messageV2.GameID,
+		Token:     messageV2.Token,
+		Type:      messageV2.Type,
+		Message:   content,
+		Payload:   payload,
+		Seq:       messageV2.Seq,
+		RequestID: messageV2.RequestID,
+	}, nil
+}
+
+// toPayload returns the content of a message as a JSON value: its JSON payload if it has one, and its content as
+// a JSON string otherwise.
+func toPayload(message WebSocketMessage) json.RawMessage {
+	if message.Payload != nil {
+		return message.Payload
+	}
+	if message.Message == "" {
+		return nil
+	}
+	payload, _ := json.Marshal(message.Message)
+	return payload
+}
+
+// fromPayload is the inverse of toPayload: a JSON string becomes the content of the message, and any other JSON
+// value becomes both its content and its payload.
+func fromPayload(payload json.RawMessage) (string, json.RawMessage, error) {
+	if len(payload) == 0 {
+		return "", nil, nil
+	}
+	var content string
+	if payload[0] == '"' {
+		err := json.Unmarshal(payload, &content)
+		return content, nil, err
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, payload); err != nil {
+		return "", nil, err
+	}
+	return compact.String(), compact.Bytes(), nil
+}
+
+// toMsgPackPayload converts the content of a message to a MessagePack value, the same way toPayload does for JSON.
+func toMsgPackPayload(message WebSocketMessage) (msgpack.RawMessage, error) {
+	if message.Payload == nil {
+		if message.Message == "" {
+			return nil, nil
+		}
+		return msgpack.Marshal(message.Message)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(message.Payload))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(withNativeNumbers(value))
+}
+
+// fromMsgPackPayload is the inverse of toMsgPackPayload.
+func fromMsgPackPayload(payload msgpack.RawMessage) (string, json.RawMessage, error) {
+	if len(payload) == 0 {
+		return "", nil, nil
+	}
+	var value interface{}
+	if err := msgpack.Unmarshal(payload, &value); err != nil {
+		return "", nil, err
+	}
+	if content, ok := value.(string); ok {
+		return content, nil, nil
+	}
+	data, err := json.Marshal(value)
+	return string(data), data, err
+}
+
+// withNativeNumbers replaces the json.Numbers in a decoded JSON value with integers where possible, and floats
+// otherwise, so that integers are not encoded as floats.
+func withNativeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = withNativeNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = withNativeNumbers(item)
+		}
+	}
+	return value
+}
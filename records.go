@@ -0,0 +1,351 @@
+// records.go makes game records tamper-evident. Every action is chained to the previous one by a hash stored
+// alongside it, and when a game ends, the server signs the hash of its last action, the head of the chain, together
+// with the header of the record, with its record key. A record exported as a RecordBundle can then be checked with
+// VerifyRecord: altering, inserting or deleting any action either breaks the chain or no longer matches the signed
+// head, and changing the header no longer matches the signature.
+
+package gameserver
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	recordKey   ed25519.PrivateKey
+	recordKeyMu sync.Mutex
+)
+
+// SetRecordKey sets the key the server signs game records with. The key is kept out of the database, so that
+// whoever can read or restore the database cannot forge records. Until a key is set, games end without their records
+// being sealed, so it should be set before InitDB.
+func SetRecordKey(key ed25519.PrivateKey) {
+	recordKeyMu.Lock()
+	defer recordKeyMu.Unlock()
+	recordKey = key
+}
+
+// LoadRecordKey sets the key the server signs game records with from a file holding the base64 encoding of an
+// Ed25519 private key or seed, such as one written by
+//
+//	openssl rand -base64 32 > record.key
+func LoadRecordKey(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid record key in %s: %v", path, err)
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		SetRecordKey(ed25519.NewKeyFromSeed(key))
+	case ed25519.PrivateKeySize:
+		SetRecordKey(ed25519.PrivateKey(key))
+	default:
+		return fmt.Errorf("invalid record key in %s: expected %d or %d bytes, got %d", path, ed25519.SeedSize, ed25519.PrivateKeySize, len(key))
+	}
+	return nil
+}
+
+func getRecordKey() (ed25519.PrivateKey, error) {
+	recordKeyMu.Lock()
+	defer recordKeyMu.Unlock()
+	if recordKey == nil {
+		return nil, fmt.Errorf("no record key has been set")
+	}
+	return recordKey, nil
+}
+
+// RecordPublicKey returns the public key that the signatures of game records can be checked with.
+func RecordPublicKey() (ed25519.PublicKey, error) {
+	key, err := getRecordKey()
+	if err != nil {
+		return nil, err
+	}
+	return key.Public().(ed25519.PublicKey), nil
+}
+
+// writeFields writes the fields to the hash, each prefixed with its length so that they cannot run into each other.
+func writeFields(h hash.Hash, fields ...string) {
+	for _, field := range fields {
+		fmt.Fprintf(h, "%d:%s", len(field), field)
+	}
+}
+
+// chainHash returns the hash of an action chained to the hash of the previous action, which is "" for the first action.
+func chainHash(previous string, gameID int, actionNum int, player string, action string, signature string) string {
+	h := sha256.New()
+	writeFields(h, previous, strconv.Itoa(gameID), strconv.Itoa(actionNum), player, action, signature)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordHeadData returns the bytes the server signs to seal the record of a finished game with the given number of
+// actions: the header of the record and the head of its chain.
+func recordHeadData(bundle *RecordBundle, numActions int) []byte {
+	h := sha256.New()
+	writeFields(h, "gameserver record", strconv.Itoa(bundle.GameID), bundle.Type, bundle.WhitePlayer, bundle.BlackPlayer,
+		bundle.WhitePublicKey, bundle.BlackPublicKey, strconv.FormatBool(bundle.GameOver), bundle.GameResult,
+		strconv.FormatBool(bundle.Imported), strconv.Itoa(numActions), bundle.Head)
+	return h.Sum(nil)
+}
+
+// chainAction stores the chain hash of an action that has just been inserted.
+func chainAction(tx *sql.Tx, gameID int, player PlayerType, action Action) error {
+	var previous string
+	if action.ActionNum > 1 {
+		err := tx.QueryRow("SELECT chain_hash FROM actions WHERE game_id = ? AND action_num = ?", gameID, action.ActionNum-1).
+			Scan(&previous)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("UPDATE actions SET chain_hash = ? WHERE game_id = ? AND action_num = ?",
+		chainHash(previous, gameID, action.ActionNum, player.String(), action.Action, action.Signature), gameID, action.ActionNum)
+	return err
+}
+
+// chainActions computes the chain hashes of the actions stored before actions were chained, so that the chains of
+// games in progress continue from them. The player of these actions is unknown, and chained as "".
+func chainActions(tx *sql.Tx) error {
+	rows, err := tx.Query(`
+		SELECT game_id, action_num, player, action, COALESCE(action_signature, '') FROM actions
+		WHERE game_id IN (SELECT DISTINCT game_id FROM actions WHERE chain_hash = '')
+		ORDER BY game_id, action_num
+	`)
+	if err != nil {
+		return err
+	}
+	type chainedAction struct {
+		gameID, actionNum int
+		hash              string
+	}
+	var chained []chainedAction
+	previous := ""
+	for rows.Next() {
+		var gameID, actionNum int
+		var player, action, signature string
+		if err := rows.Scan(&gameID, &actionNum, &player, &action, &signature); err != nil {
+			rows.Close()
+			return err
+		}
+		if actionNum == 1 {
+			previous = ""
+		}
+		previous = chainHash(previous, gameID, actionNum, player, action, signature)
+		chained = append(chained, chainedAction{gameID, actionNum, previous})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, action := range chained {
+		_, err := tx.Exec("UPDATE actions SET chain_hash = ? WHERE game_id = ? AND action_num = ?", action.hash, action.gameID, action.actionNum)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealRecord signs the head of the chain of actions of a game that has just finished with the given result.
+func sealRecord(tx *sql.Tx, key ed25519.PrivateKey, gameID int, result string) error {
+	var numActions int
+	var head string
+	err := tx.QueryRow(`
+		SELECT COUNT(*), COALESCE((SELECT chain_hash FROM actions WHERE game_id = ? ORDER BY action_num DESC LIMIT 1), '')
+		FROM actions WHERE game_id = ?
+	`, gameID, gameID).Scan(&numActions, &head)
+	if err != nil {
+		return err
+	}
+	header, err := recordHeader(tx, gameID)
+	if err != nil {
+		return err
+	}
+	if header.Imported {
+		return newCodedError(ErrorNotAllowed, "the records of imported games cannot be sealed")
+	}
+	header.GameOver, header.GameResult, header.Head = true, result, head
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, recordHeadData(header, numActions)))
+	publicKey := base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	_, err = tx.Exec("UPDATE games SET record_head = ?, record_signature = ?, record_key = ? WHERE id = ?", head, signature, publicKey, gameID)
+	return err
+}
+
+// RecordAction is an action in an exported game record.
+type RecordAction struct {
+	ActionNum int    `json:"action_num"`
+	Player    string `json:"player"`
+	Action    string `json:"action"`
+	Signature string `json:"signature"`
+	Hash      string `json:"hash"`
+}
+
+// RecordBundle is a self-contained record of a game, which can be checked with VerifyRecord.
+type RecordBundle struct {
+	GameID         int    `json:"game_id"`
+	Type           string `json:"type"`
+	WhitePlayer    string `json:"white_player"`
+	BlackPlayer    string `json:"black_player"`
+	WhitePublicKey string `json:"white_public_key,omitempty"`
+	BlackPublicKey string `json:"black_public_key,omitempty"`
+	GameOver       bool   `json:"game_over"`
+	GameResult     string `json:"game_result"`
+	// Imported records were played elsewhere, and are not sealed by the server.
+	Imported bool           `json:"imported,omitempty"`
+	Actions  []RecordAction `json:"actions"`
+	// Head and Signature seal the record of a finished game; they are empty while the game is in progress.
+	Head      string `json:"head"`
+	Signature string `json:"signature"`
+	// RecordKey is the public key of the server that sealed the record, which need not be its current key.
+	RecordKey string `json:"record_key"`
+}
+
+func ExportRecord(gameID int) (*RecordBundle, error) {
+	bundle, err := recordHeader(db, gameID)
+	if err != nil {
+		return nil, err
+	}
+	bundle.Actions, err = getRecordActions(gameID)
+	if err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// recordHeader returns the record of the game without its actions. Like GetGameWithId, it names the players who are
+// users after them, and the others after their imported names.
+func recordHeader(q queryer, gameID int) (*RecordBundle, error) {
+	var bundle RecordBundle
+	err := q.QueryRow(`
+		SELECT g.id, g.type, COALESCE(u1.screen_name, g.white_name), COALESCE(u2.screen_name, g.black_name),
+			g.white_public_key, g.black_public_key, g.game_over, g.game_result, g.imported,
+			g.record_head, g.record_signature, g.record_key
+		FROM games g
+		LEFT JOIN users u1 ON g.white_user_id = u1.id
+		LEFT JOIN users u2 ON g.black_user_id = u2.id
+		WHERE g.id = ?
+	`, gameID).Scan(&bundle.GameID, &bundle.Type, &bundle.WhitePlayer, &bundle.BlackPlayer, &bundle.WhitePublicKey,
+		&bundle.BlackPublicKey, &bundle.GameOver, &bundle.GameResult, &bundle.Imported, &bundle.Head, &bundle.Signature,
+		&bundle.RecordKey)
+	if err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// getRecordActions returns the actions of the game in order, along with who made them.
+func getRecordActions(gameID int) ([]RecordAction, error) {
+	rows, err := db.Query(`
+		SELECT action_num, player, action, COALESCE(action_signature, ''), chain_hash
+		FROM actions WHERE game_id = ? ORDER BY action_num
+	`, gameID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	actions := []RecordAction{}
+	for rows.Next() {
+		var action RecordAction
+		if err := rows.Scan(&action.ActionNum, &action.Player, &action.Action, &action.Signature, &action.Hash); err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	return actions, rows.Err()
+}
+
+// VerifyRecord checks that the record has been sealed with the given record key and has not been changed since: that
+// no action has been altered, inserted or deleted, and that the actions of players with registered keys are signed.
+// If recordKey is nil, the key included in the bundle is used, which only shows that the record is consistent,
+// not that it comes from a trusted server.
+func VerifyRecord(bundle *RecordBundle, recordKey ed25519.PublicKey) error {
+	if bundle.Imported {
+		return fmt.Errorf("the game was imported from a record, so it cannot be verified")
+	} else if bundle.Signature == "" && bundle.GameOver {
+		return fmt.Errorf("the record of the game was not sealed when it ended, so it cannot be verified")
+	} else if bundle.Signature == "" {
+		return fmt.Errorf("the record has not been sealed")
+	}
+	if recordKey == nil {
+		key, err := decodePublicKey(bundle.RecordKey)
+		if err != nil {
+			return fmt.Errorf("invalid record key: %v", err)
+		}
+		recordKey = key
+	}
+
+	previous := ""
+	for i, action := range bundle.Actions {
+		if action.ActionNum != i+1 {
+			return fmt.Errorf("expected action %d, got %d", i+1, action.ActionNum)
+		}
+		if chainHash(previous, bundle.GameID, action.ActionNum, action.Player, action.Action, action.Signature) != action.Hash {
+			return fmt.Errorf("action %d has been altered", action.ActionNum)
+		}
+		publicKey := ""
+		switch action.Player {
+		case WhitePlayer.String():
+			publicKey = bundle.WhitePublicKey
+		case BlackPlayer.String():
+			publicKey = bundle.BlackPublicKey
+		}
+		if publicKey != "" {
+			err := verifySignature(publicKey, bundle.GameID, Action{ActionNum: action.ActionNum, Action: action.Action, Signature: action.Signature})
+			if err != nil {
+				return err
+			}
+		}
+		previous = action.Hash
+	}
+
+	if previous != bundle.Head {
+		return fmt.Errorf("the actions do not end at the sealed head of the record")
+	}
+	signature, err := base64.StdEncoding.DecodeString(bundle.Signature)
+	if err != nil || !ed25519.Verify(recordKey, recordHeadData(bundle, len(bundle.Actions)), signature) {
+		return fmt.Errorf("invalid record signature")
+	}
+	return nil
+}
+
+// recordHandler serves GET prefix/{id}/record, which exports the record of the game as a RecordBundle.
+// Private games require a token in the "token" query parameter.
+func recordHandler(w http.ResponseWriter, r *http.Request, gameID int) {
+	game, err := GetGameWithId(gameID)
+	if err != nil {
+		sendError(w, serverError("cannot find game", err))
+		return
+	}
+	if !canWatch(r, game) {
+		sendError(w, serverError("invalid token", nil))
+		return
+	}
+	bundle, err := ExportRecord(gameID)
+	if err != nil {
+		sendError(w, serverError("cannot export record", err))
+		return
+	}
+	writeJSONResponse(w, bundle)
+}
+
+func recordKeyHandler(w http.ResponseWriter, r *http.Request) {
+	publicKey, err := RecordPublicKey()
+	if err != nil {
+		sendError(w, serverError("cannot get record key", err))
+		return
+	}
+	writeJSONResponse(w, map[string]string{"record_key": base64.StdEncoding.EncodeToString(publicKey)})
+}
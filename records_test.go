@@ -0,0 +1,145 @@
+package gameserver_test
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/vkryukov/gameserver"
+)
+
+// mustPlayGame makes the given moves in a new game, alternating between the players, and finishes it with the result.
+func mustPlayGame(t *testing.T, moves []string, result string) *gameserver.Game {
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user1, true, true)
+	mustJoinGame(t, user2, game)
+	url := fmt.Sprintf("http://localhost:1234/game/%d/actions", game.Id)
+	for i, move := range moves {
+		token := user1.Token
+		if i%2 == 1 {
+			token = user2.Token
+		}
+		resp := postObject(t, url, map[string]interface{}{"token": token, "action_num": i + 1, "action": move})
+		if isErrorResponse(resp, "") {
+			t.Fatalf("Failed to make action %d: %s", i+1, resp)
+		}
+	}
+	if result != "" {
+		conn := mustDialWS(t)
+		mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Join"})
+		mustReadWSMessageOfType(t, conn, "GameJoined")
+		mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "GameOver", Message: result})
+		mustReadWSMessageOfType(t, conn, "GameOver")
+	}
+	return game
+}
+
+func mustExportRecord(t *testing.T, gameID int) *gameserver.RecordBundle {
+	bundle, err := gameserver.ExportRecord(gameID)
+	if err != nil {
+		t.Fatalf("Failed to export record: %v", err)
+	}
+	return bundle
+}
+
+func TestRecordVerification(t *testing.T) {
+	game := mustPlayGame(t, []string{"a", "b", "c"}, "Game won by white")
+	recordKey, err := gameserver.RecordPublicKey()
+	if err != nil {
+		t.Fatalf("Failed to get record key: %v", err)
+	}
+
+	// Test 1: an untouched record is verified
+	var bundle gameserver.RecordBundle
+	mustDecodeRequestWithObject(t, fmt.Sprintf("http://localhost:1234/game/%d/record", game.Id), nil, &bundle)
+	if len(bundle.Actions) != 3 || bundle.Head != bundle.Actions[2].Hash || bundle.Signature == "" {
+		t.Fatalf("Unexpected record: %s", mustPrettyPrint(t, bundle))
+	}
+	if err := gameserver.VerifyRecord(&bundle, recordKey); err != nil {
+		t.Fatalf("Expected the record to be verified, got %v", err)
+	}
+
+	// Test 2: altered, inserted and deleted actions and changed headers are detected
+	tamper := map[string]func(b *gameserver.RecordBundle){
+		"altered": func(b *gameserver.RecordBundle) { b.Actions[1].Action = "x" },
+		"inserted": func(b *gameserver.RecordBundle) {
+			b.Actions = append(b.Actions, gameserver.RecordAction{ActionNum: 4, Player: "black", Action: "d", Hash: b.Head})
+		},
+		"deleted":   func(b *gameserver.RecordBundle) { b.Actions = append(b.Actions[:1], b.Actions[2:]...) },
+		"truncated": func(b *gameserver.RecordBundle) { b.Actions = b.Actions[:2] },
+		"rehashed": func(b *gameserver.RecordBundle) {
+			b.Actions = b.Actions[:2]
+			b.Head = b.Actions[1].Hash
+		},
+		"result":  func(b *gameserver.RecordBundle) { b.GameResult = "Game won by black" },
+		"type":    func(b *gameserver.RecordBundle) { b.Type = "Chess" },
+		"player":  func(b *gameserver.RecordBundle) { b.WhitePlayer = "someone else" },
+		"ongoing": func(b *gameserver.RecordBundle) { b.GameOver = false },
+	}
+	for name, f := range tamper {
+		b := mustExportRecord(t, game.Id)
+		f(b)
+		if err := gameserver.VerifyRecord(b, recordKey); err == nil {
+			t.Fatalf("Expected the %s record to fail verification", name)
+		}
+	}
+
+	// Test 3: changes made directly in the database are detected
+	if err := gameserver.ExecuteSQL("UPDATE actions SET action = 'x' WHERE game_id = ? AND action_num = 2", game.Id); err != nil {
+		t.Fatalf("Failed to update action: %v", err)
+	}
+	if err := gameserver.VerifyRecord(mustExportRecord(t, game.Id), recordKey); err == nil || !strings.Contains(err.Error(), "altered") {
+		t.Fatalf("Expected the altered action to be detected, got %v", err)
+	}
+
+	// Test 4: records of games in progress are not sealed
+	game = mustPlayGame(t, []string{"a"}, "")
+	if err := gameserver.VerifyRecord(mustExportRecord(t, game.Id), recordKey); err == nil || !strings.Contains(err.Error(), "not been sealed") {
+		t.Fatalf("Expected an unsealed record, got %v", err)
+	}
+
+	// Test 5: records keep the key they were sealed with when the server's key changes
+	_, newKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	old := mustPlayGame(t, []string{"a"}, "Draw")
+	gameserver.SetRecordKey(newKey)
+	defer gameserver.SetRecordKey(serverRecordKey)
+	game = mustPlayGame(t, []string{"a"}, "Draw")
+	for _, record := range []struct {
+		gameID int
+		key    ed25519.PublicKey
+	}{{old.Id, recordKey}, {game.Id, newKey.Public().(ed25519.PublicKey)}} {
+		bundle := mustExportRecord(t, record.gameID)
+		if bundle.RecordKey != base64.StdEncoding.EncodeToString(record.key) {
+			t.Fatalf("Expected record %d to be sealed with %x, got %s", record.gameID, record.key, bundle.RecordKey)
+		}
+		if err := gameserver.VerifyRecord(bundle, record.key); err != nil {
+			t.Fatalf("Expected record %d to be verified, got %v", record.gameID, err)
+		}
+	}
+
+	// Test 6: finished games cannot be finished again with another result
+	conn := mustDialWS(t)
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: game.WhiteToken, Type: "Join"})
+	mustReadWSMessageOfType(t, conn, "GameJoined")
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: game.WhiteToken, Type: "GameOver", Message: "Game won by black"})
+	if resp := mustReadWSMessageOfType(t, conn, "Error"); resp.ErrorCode != gameserver.ErrorGameOver {
+		t.Fatalf("Expected the second end of the game to be refused, got %s", mustPrettyPrint(t, resp))
+	}
+	if bundle := mustExportRecord(t, game.Id); bundle.GameResult != "Draw" {
+		t.Fatalf("Expected the result to be kept, got %q", bundle.GameResult)
+	}
+
+	// Test 7: without a record key, games end without their records being sealed
+	gameserver.SetRecordKey(nil)
+	game = mustPlayGame(t, []string{"a"}, "Draw")
+	bundle = *mustExportRecord(t, game.Id)
+	if err := gameserver.VerifyRecord(&bundle, recordKey); bundle.Signature != "" || err == nil || !strings.Contains(err.Error(), "cannot be verified") {
+		t.Fatalf("Expected an unsealed record, got %s (%v)", mustPrettyPrint(t, bundle), err)
+	}
+}
@@ -0,0 +1,183 @@
+// rematch.go implements rematches: once both players of a finished game agree, a new game of the same type
+// and visibility is created with the colors swapped.
+
+package gameserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// rematchOffers records, for each finished game, which players have asked for a rematch so far.
+var (
+	rematchOffers   = make(map[int]map[PlayerType]bool)
+	rematchOffersMu sync.Mutex
+)
+
+// requestRematch registers the player's agreement to a rematch of the given game. When both players have agreed,
+// it creates the new game and returns it; until then it returns nil. Asking for a rematch of a game that already
+// has one returns the existing rematch game.
+func requestRematch(gameID int, player PlayerType) (*Game, error) {
+	if player != WhitePlayer && player != BlackPlayer {
+		return nil, newCodedError(ErrorNotAllowed, "only players can request a rematch")
+	}
+
+	// The rematch game is checked for under the lock, so that the request cannot miss a rematch that a concurrent
+	// request has just created.
+	rematchOffersMu.Lock()
+	defer rematchOffersMu.Unlock()
+
+	var gameOver bool
+	var rematchGameID int
+	err := db.QueryRow("SELECT game_over, rematch_game_id FROM games WHERE id = ?", gameID).Scan(&gameOver, &rematchGameID)
+	if err != nil {
+		return nil, err
+	}
+	if !gameOver {
+		return nil, newCodedError(ErrorNotAllowed, "cannot rematch a game that is not over")
+	}
+	if rematchGameID != 0 {
+		return GetGameWithId(rematchGameID)
+	}
+
+	if rematchOffers[gameID] == nil {
+		rematchOffers[gameID] = make(map[PlayerType]bool)
+	}
+	rematchOffers[gameID][player] = true
+	if !rematchOffers[gameID][WhitePlayer] || !rematchOffers[gameID][BlackPlayer] {
+		return nil, nil
+	}
+
+	rematchGameID, err = createRematchGame(gameID)
+	if err != nil {
+		return nil, err
+	}
+	delete(rematchOffers, gameID)
+	rematchGame, err := GetGameWithId(rematchGameID)
+	if err != nil {
+		return nil, err
+	}
+	lobbyGameCreated(rematchGame)
+	return rematchGame, nil
+}
+
+// createRematchGame creates a new game with the same type and visibility as the given one, but with swapped colors,
+// and links the old game to it.
+func createRematchGame(gameID int) (int, error) {
+	var gameType string
+	var whiteUserID, blackUserID int
+	var viewerToken Token
+	err := db.QueryRow("SELECT type, white_user_id, black_user_id, viewer_token FROM games WHERE id = ?", gameID).
+		Scan(&gameType, &whiteUserID, &blackUserID, &viewerToken)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	rematchGameID, err := insertGame(tx, gameType, blackUserID, whiteUserID, viewerToken == "")
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE games SET rematch_game_id = ? WHERE id = ?", rematchGameID, gameID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return rematchGameID, tx.Commit()
+}
+
+// rematchSeat returns the color that the given player of the original game plays in its rematch.
+func rematchSeat(player PlayerType) PlayerType {
+	if player == WhitePlayer {
+		return BlackPlayer
+	}
+	return WhitePlayer
+}
+
+// seatToken returns the game token of the given player.
+func (game *Game) seatToken(player PlayerType) Token {
+	switch player {
+	case WhitePlayer:
+		return game.WhiteToken
+	case BlackPlayer:
+		return game.BlackToken
+	default:
+		return game.ViewerToken
+	}
+}
+
+// notifyRematch tells all connections to the game about the rematch offer or the newly created rematch game.
+// The requester's connection, if any, also receives their seat token in the new game.
+func notifyRematch(conn Conn, request WebSocketMessage, player PlayerType, rematchGame *Game) {
+	gameID := request.GameID
+	if rematchGame == nil {
+		message, err := newJSONMessage(gameID, "RematchOffered", map[string]interface{}{
+			"player": player.String(),
+		})
+		if err == nil {
+			broadcast(gameID, message)
+		}
+		return
+	}
+
+	message, err := newJSONMessage(gameID, "Rematch", map[string]interface{}{
+		"game_id":   rematchGame.Id,
+		"game_type": rematchGame.Type,
+	})
+	if err != nil {
+		return
+	}
+	broadcastExcept(gameID, conn, message)
+	if conn.Conn != nil {
+		err = sendReply(conn, request, "Rematch", map[string]interface{}{
+			"game_id":    rematchGame.Id,
+			"game_type":  rematchGame.Type,
+			"player":     rematchSeat(player).String(),
+			"game_token": rematchGame.seatToken(rematchSeat(player)),
+		})
+		if err != nil {
+			log.Printf("Error sending rematch to %s: %v", conn, err)
+		}
+	}
+}
+
+func rematchGameHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Id    int   `json:"id"`
+		Token Token `json:"token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		sendError(w, serverError("incorrect request", err))
+		return
+	}
+	player, _ := validateGameToken(request.Id, request.Token)
+	if player != WhitePlayer && player != BlackPlayer {
+		sendError(w, serverError("invalid token", nil))
+		return
+	}
+	rematchGame, err := requestRematch(request.Id, player)
+	if err != nil {
+		sendError(w, serverError("cannot rematch: "+err.Error(), err))
+		return
+	}
+	notifyRematch(Conn{}, WebSocketMessage{GameID: request.Id}, player, rematchGame)
+	if rematchGame == nil {
+		writeJSONResponse(w, map[string]interface{}{"status": "rematch offered", "id": request.Id})
+		return
+	}
+
+	// We only want to return the token of the player who made the request.
+	if rematchSeat(player) == WhitePlayer {
+		rematchGame.BlackToken = ""
+	} else {
+		rematchGame.WhiteToken = ""
+	}
+	writeJSONResponse(w, rematchGame)
+}
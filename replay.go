@@ -0,0 +1,105 @@
+// replay.go replays finished games over a WebSocket. After "Replay", the connection receives the actions of the game
+// one by one as "ReplayAction" messages, with the pauses between them that the players took, optionally shortened,
+// followed by "ReplayFinished".
+
+package gameserver
+
+import (
+	"database/sql"
+	"time"
+)
+
+type replayRequest struct {
+	// Speed is how many times faster than the players the actions are replayed; 0 means the recorded speed.
+	Speed float64 `json:"speed"`
+	// MaxDelay is the longest pause between two actions, in milliseconds; 0 means no limit.
+	MaxDelay int `json:"max_delay"`
+}
+
+type replayedAction struct {
+	Action
+	// Delay is the pause before the action, in milliseconds.
+	Delay int `json:"delay"`
+}
+
+// getReplayedActions returns the actions of the game with the pauses before them at the given speed.
+func getReplayedActions(gameID int, request replayRequest) ([]replayedAction, error) {
+	rows, err := db.Query("SELECT action_num, action, action_signature, creation_time FROM actions WHERE game_id = ? ORDER BY action_num", gameID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	speed := request.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+	actions := []replayedAction{}
+	var previous float64
+	for rows.Next() {
+		var action replayedAction
+		var signature sql.NullString
+		var creationTime float64
+		if err := rows.Scan(&action.ActionNum, &action.Action.Action, &signature, &creationTime); err != nil {
+			return nil, err
+		}
+		action.Signature = signature.String
+		if len(actions) > 0 && creationTime > previous {
+			action.Delay = int((creationTime - previous) / speed)
+		}
+		if request.MaxDelay > 0 && action.Delay > request.MaxDelay {
+			action.Delay = request.MaxDelay
+		}
+		previous = creationTime
+		actions = append(actions, action)
+	}
+	return actions, rows.Err()
+}
+
+// sendReplyWaiting sends a message of the given type in reply to the request like sendReply, but waits for room in
+// the connection's queue instead of closing the connection when the queue is full, so that replays without pauses
+// do not overflow it.
+func sendReplyWaiting(conn Conn, request WebSocketMessage, messageType string, data any) error {
+	message, err := newJSONMessage(request.GameID, messageType, data)
+	if err != nil {
+		return err
+	}
+	message.RequestID = request.RequestID
+	select {
+	case conn.messages <- message:
+		return nil
+	case <-conn.closed:
+		return errConnectionClosed
+	}
+}
+
+// replayGame starts replaying the finished game to the connection, and stops when the connection is closed.
+func replayGame(conn Conn, message WebSocketMessage, request replayRequest) {
+	game, err := GetGameWithId(message.GameID)
+	if handleError(conn, message, err) {
+		return
+	}
+	if !game.GameOver {
+		handleError(conn, message, newCodedError(ErrorNotAllowed, "only finished games can be replayed"))
+		return
+	}
+	actions, err := getReplayedActions(message.GameID, request)
+	if handleError(conn, message, err) {
+		return
+	}
+	sendReply(conn, message, "ReplayStarted", map[string]int{"num_actions": len(actions)})
+
+	go func() {
+		for _, action := range actions {
+			select {
+			case <-time.After(time.Duration(action.Delay) * time.Millisecond):
+			case <-conn.closed:
+				return
+			}
+			if sendReplyWaiting(conn, message, "ReplayAction", action) != nil {
+				return
+			}
+		}
+		sendReplyWaiting(conn, message, "ReplayFinished", map[string]string{"game_result": game.GameResult})
+	}()
+}
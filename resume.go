@@ -0,0 +1,159 @@
+// resume.go lets clients resume a WebSocket session after reconnecting without receiving the whole game again.
+//
+// Every message broadcast to a game gets a sequence number, and the most recent broadcasts are kept in memory.
+// A reconnecting client sends "Resume" with the last action and sequence number it has seen, and receives only
+// the actions and events it has missed. A client that notices a gap in sequence numbers can ask for the missing
+// messages with "Retransmit".
+
+package gameserver
+
+import (
+	"log"
+)
+
+// streamHistorySize is the number of recent broadcasts kept for each game.
+const streamHistorySize = 256
+
+type gameStream struct {
+	seq     int
+	history []WebSocketMessage
+}
+
+// record assigns the next sequence number of the stream to the message and remembers it.
+func (stream *gameStream) record(message WebSocketMessage) WebSocketMessage {
+	stream.seq++
+	message.Seq = stream.seq
+	stream.history = append(stream.history, message)
+	if len(stream.history) > streamHistorySize {
+		stream.history = stream.history[len(stream.history)-streamHistorySize:]
+	}
+	return message
+}
+
+// since returns the messages recorded after the given sequence number, and whether all of them are still available.
+func (stream *gameStream) since(seq int) ([]WebSocketMessage, bool) {
+	messages := []WebSocketMessage{}
+	for _, message := range stream.history {
+		if message.Seq > seq {
+			messages = append(messages, message)
+		}
+	}
+	if len(stream.history) == 0 {
+		return messages, seq >= stream.seq
+	}
+	return messages, stream.history[0].Seq <= seq+1
+}
+
+// broadcastsSince returns the messages broadcast to the game after the given sequence number, and whether
+// all of them are still available. It does not start a hub for the game if none is running.
+func broadcastsSince(gameID int, seq int) ([]WebSocketMessage, bool) {
+	var messages []WebSocketMessage
+	var complete bool
+	running := withHub(gameID, false, func(h *gameHub) {
+		messages, complete = h.stream.since(seq)
+	})
+	if !running {
+		hubsMu.Lock()
+		stream := gameStream{seq: retiredSeq(gameID)}
+		hubsMu.Unlock()
+		messages, complete = stream.since(seq)
+	}
+	return messages, complete
+}
+
+type resumeRequest struct {
+	LastAction int `json:"last_action"`
+	LastSeq    int `json:"last_seq"`
+}
+
+type retransmitRequest struct {
+	// FromSeq is the last sequence number the client has received: the messages after it are retransmitted.
+	FromSeq int `json:"from_seq"`
+}
+
+// catchUp is what a connection joining a game has missed.
+type catchUp struct {
+	isNew    bool
+	actions  []Action
+	events   []WebSocketMessage
+	complete bool
+	seq      int
+}
+
+// joinAndCatchUp registers the connection with the game like addConnection, and returns the actions after lastAction
+// and the broadcasts after lastSeq. They are read in the hub goroutine, so that every action is either returned or
+// broadcast to the connection afterwards. Broadcasts of the returned actions are not sent to the connection,
+// in case they were saved before but broadcast after the connection joined.
+func joinAndCatchUp(gameID int, conn Conn, player PlayerType, lastAction int, lastSeq int) (*catchUp, error) {
+	var result catchUp
+	var err error
+	withHub(gameID, true, func(h *gameHub) {
+		result.isNew = h.add(conn, player)
+		result.actions, err = getActionsSince(gameID, lastAction)
+		if err != nil {
+			return
+		}
+		if len(result.actions) > 0 {
+			h.skipActionsUpTo(conn, result.actions[len(result.actions)-1].ActionNum)
+		}
+		result.events, result.complete = h.stream.since(lastSeq)
+		result.seq = h.stream.seq
+	})
+	conn.joinedGame(gameID)
+	return &result, err
+}
+
+// resumeGame registers the connection with the game, like "Join", but replies only with what the client has missed.
+func resumeGame(conn Conn, message WebSocketMessage, playerType PlayerType, token Token, request resumeRequest) {
+	gameID := message.GameID
+	game, err := GetGameWithId(gameID)
+	if handleError(conn, message, err) {
+		return
+	}
+	joined, err := joinAndCatchUp(gameID, conn, playerType, request.LastAction, request.LastSeq)
+	if handleError(conn, message, err) {
+		return
+	}
+	if joined.isNew {
+		playerConnected(conn, gameID, playerType)
+	}
+	lobbyPlayerIdentified(conn, gameID, playerType)
+	presence, err := getPresence(gameID)
+	if handleError(conn, message, err) {
+		return
+	}
+
+	// Missed actions are already included in the list of actions.
+	events := []WebSocketMessage{}
+	for _, broadcast := range joined.events {
+		if broadcast.Type != "Action" {
+			events = append(events, broadcast)
+		}
+	}
+	sendReply(conn, message, "Resumed", map[string]interface{}{
+		"player":          playerType.String(),
+		"game_token":      token,
+		"actions":         joined.actions,
+		"events":          events,
+		"events_complete": joined.complete,
+		"seq":             joined.seq,
+		"game_over":       game.GameOver,
+		"game_result":     game.GameResult,
+		"presence":        presence,
+	})
+}
+
+// retransmit sends the connection the broadcasts it has missed after the given sequence number, in their original form.
+func retransmit(conn Conn, request WebSocketMessage, fromSeq int) {
+	messages, complete := broadcastsSince(request.GameID, fromSeq)
+	if !complete {
+		handleError(conn, request, newCodedError(ErrorUnavailable, "cannot retransmit messages after %d: they are no longer available", fromSeq))
+		return
+	}
+	for _, message := range messages {
+		if err := conn.Send(message); err != nil {
+			log.Printf("Error retransmitting message to %s: %v", conn, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// rules.go lets the application plug in the rules of the games it hosts. The server itself does not know the rules
+// of any game: it stores and relays actions as opaque strings. When a rules engine is registered for a type of game,
+// the server uses it wherever it needs to understand the actions, such as when validating imported records.
+
+package gameserver
+
+import (
+	"fmt"
+	"sync"
+)
+
+// RulesEngine implements the rules of a type of game.
+type RulesEngine interface {
+	// InitialState returns the state of the game before the first action.
+	InitialState() GameState
+}
+
+// GameState is the state of a game at some point. States must not be modified once created, since they may be cached
+// and shared, and are sent to clients as JSON.
+type GameState interface {
+	// Apply returns the state after the given action, or an error if the action is not legal in this state.
+	Apply(action string) (GameState, error)
+}
+
+// TurnState is implemented by game states that know whose turn it is. Turn order is only enforced for games whose
+// states implement it.
+type TurnState interface {
+	// ToMove returns the player who makes the next action.
+	ToMove() PlayerType
+}
+
+var (
+	rulesEngines   = make(map[string]RulesEngine)
+	rulesEnginesMu sync.RWMutex
+)
+
+// RegisterRulesEngine registers the rules engine for the given type of game, replacing any previous one.
+func RegisterRulesEngine(gameType string, engine RulesEngine) {
+	rulesEnginesMu.Lock()
+	defer rulesEnginesMu.Unlock()
+	rulesEngines[gameType] = engine
+}
+
+// getRulesEngine returns the rules engine registered for the type of game, or nil if there is none.
+func getRulesEngine(gameType string) RulesEngine {
+	rulesEnginesMu.RLock()
+	defer rulesEnginesMu.RUnlock()
+	return rulesEngines[gameType]
+}
+
+// playerToMove returns the player who makes the action with the given number, or Viewer if the rules engine of the
+// game cannot tell. It returns an error with ErrorInvalidActionNumber if the actions before it have not all been
+// made yet.
+func playerToMove(gameID int, actionNum int) (PlayerType, error) {
+	state, err := GetPosition(gameID, actionNum-1)
+	if errorCode(err) == ErrorUnavailable {
+		state, err = nil, nil
+	}
+	if err != nil {
+		return Viewer, err
+	}
+	if turnState, ok := state.(TurnState); ok {
+		return turnState.ToMove(), nil
+	}
+	return Viewer, nil
+}
+
+// defaultPlayer returns the player assumed to have made the action with the given number when it was not recorded:
+// white makes the odd actions and black the even ones.
+func defaultPlayer(actionNum int) PlayerType {
+	if actionNum%2 == 1 {
+		return WhitePlayer
+	}
+	return BlackPlayer
+}
+
+// replayActions applies the actions in order to the initial state of the engine, and returns the resulting state.
+func replayActions(engine RulesEngine, actions []string) (GameState, error) {
+	state := engine.InitialState()
+	for i, action := range actions {
+		next, err := state.Apply(action)
+		if err != nil {
+			return nil, fmt.Errorf("action %d (%s) is not legal: %v", i+1, action, err)
+		}
+		state = next
+	}
+	return state, nil
+}
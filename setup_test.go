@@ -3,9 +3,11 @@ package gameserver_test
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -30,18 +32,29 @@ var (
 	baseURL string
 	srv     http.Server
 	ws      *websocket.Conn
+	// serverRecordKey is the key the server signs game records with.
+	serverRecordKey ed25519.PrivateKey
 )
 
 func setup() {
+	var err error
+	if _, serverRecordKey, err = ed25519.GenerateKey(nil); err != nil {
+		log.Fatalf("Failed to generate the record key: %v", err)
+	}
+	gameserver.SetRecordKey(serverRecordKey)
 	if err := gameserver.InitDB(":memory:"); err != nil {
 		log.Fatalf("Failed to initialize DB: %v", err)
 	}
 	gameserver.SetMailServer(&gameserver.MockEmailSender{})
 	gameserver.SetMiddlewareConfig(true, false)
-	gameserver.StartPrintingLog(time.Second)
+	// The shared connection ws only reads when a test uses it, so it does not answer pings in between.
+	config := gameserver.DefaultWebSocketConfig()
+	config.PongTimeout = 10 * time.Minute
+	gameserver.SetWebSocketConfig(config)
 	if err := gameserver.InitLogDB(":memory:"); err != nil {
 		log.Fatalf("Failed to initialize log DB: %v", err)
 	}
+	gameserver.StartPrintingLog(time.Second)
 	port = ":1234"
 	baseURL = "http://localhost" + port
 	srv = http.Server{
@@ -50,9 +63,14 @@ func setup() {
 	}
 	gameserver.RegisterAuthHandlers("/auth", baseURL)
 	gameserver.RegisterGameHandlers("/game")
+	// Listen synchronously so that the server is ready before we dial the WebSocket below.
+	listener, err := net.Listen("tcp", port)
+	if err != nil {
+		log.Fatalf("Listen(): %v", err)
+	}
 	go func() {
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatalf("ListenAndServe(): %v", err)
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
+			log.Fatalf("Serve(): %v", err)
 		}
 	}()
 
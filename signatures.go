@@ -0,0 +1,164 @@
+// signatures.go lets players sign their actions, so that anyone can check that a game's record was really produced
+// by its players. A player registers an Ed25519 public key for their seat when creating or joining a game; from then
+// on, every action they make must carry a signature of ActionSigningData by the matching private key, and actions
+// with a missing or invalid signature are rejected. Players who have not registered a key make unsigned actions.
+
+package gameserver
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+)
+
+// ActionSigningData returns the bytes a player signs to make the given action.
+func ActionSigningData(gameID int, actionNum int, action string) []byte {
+	return []byte(fmt.Sprintf("gameserver action\n%d\n%d\n%s", gameID, actionNum, action))
+}
+
+// SignAction returns the signature of the action by the given key, in the form expected in Action.Signature.
+func SignAction(key ed25519.PrivateKey, gameID int, actionNum int, action string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, ActionSigningData(gameID, actionNum, action)))
+}
+
+func decodePublicKey(publicKey string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key: expected %d base64-encoded bytes", ed25519.PublicKeySize)
+	}
+	return key, nil
+}
+
+// checkPublicKey checks that the key, if given, is a valid Ed25519 public key.
+func checkPublicKey(publicKey string) error {
+	if publicKey == "" {
+		return nil
+	}
+	_, err := decodePublicKey(publicKey)
+	return err
+}
+
+func publicKeyColumn(player PlayerType) string {
+	if player == WhitePlayer {
+		return "white_public_key"
+	}
+	return "black_public_key"
+}
+
+// registerPublicKey registers the key of the given player of the game. A key cannot be replaced once registered.
+func registerPublicKey(exec execer, gameID int, player PlayerType, publicKey string) error {
+	if err := checkPublicKey(publicKey); err != nil {
+		return err
+	}
+	column := publicKeyColumn(player)
+	res, err := exec.Exec("UPDATE games SET "+column+" = ? WHERE id = ? AND "+column+" = ''", publicKey, gameID)
+	if err != nil {
+		return err
+	}
+	if updated, err := res.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return fmt.Errorf("a public key is already registered for the %s player", player)
+	}
+	return nil
+}
+
+// verifySignature checks the signature of an action made with the given public key.
+func verifySignature(publicKey string, gameID int, action Action) error {
+	key, err := decodePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(action.Signature)
+	if err != nil || !ed25519.Verify(key, ActionSigningData(gameID, action.ActionNum, action.Action), signature) {
+		return newCodedError(ErrorInvalidSignature, "invalid signature of action %d", action.ActionNum)
+	}
+	return nil
+}
+
+// checkActionSignature checks the signature of an action made by the given player, if the player has registered a key.
+func checkActionSignature(q queryer, gameID int, player PlayerType, action Action) error {
+	var publicKey string
+	err := q.QueryRow("SELECT "+publicKeyColumn(player)+" FROM games WHERE id = ?", gameID).Scan(&publicKey)
+	if err != nil || publicKey == "" {
+		return err
+	}
+	return verifySignature(publicKey, gameID, action)
+}
+
+// ActionVerification is the result of verifying the signature of a single action.
+type ActionVerification struct {
+	ActionNum int    `json:"action_num"`
+	Player    string `json:"player"`
+	Signed    bool   `json:"signed"`
+	Valid     bool   `json:"valid"`
+}
+
+// GameVerification is the result of verifying the signatures of all the actions of a game.
+type GameVerification struct {
+	GameID         int    `json:"game_id"`
+	WhitePublicKey string `json:"white_public_key"`
+	BlackPublicKey string `json:"black_public_key"`
+	// Verified is true if every action of the game is signed with the key of the player who made it.
+	Verified bool                 `json:"verified"`
+	Actions  []ActionVerification `json:"actions"`
+}
+
+func verifyGame(gameID int) (*GameVerification, error) {
+	verification := GameVerification{GameID: gameID, Verified: true, Actions: []ActionVerification{}}
+	err := db.QueryRow("SELECT white_public_key, black_public_key FROM games WHERE id = ?", gameID).
+		Scan(&verification.WhitePublicKey, &verification.BlackPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT action_num, action, action_signature, player FROM actions WHERE game_id = ? ORDER BY action_num", gameID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var action Action
+		var signature sql.NullString
+		var result ActionVerification
+		if err := rows.Scan(&action.ActionNum, &action.Action, &signature, &result.Player); err != nil {
+			return nil, err
+		}
+		action.Signature = signature.String
+		result.ActionNum = action.ActionNum
+		publicKey := ""
+		switch result.Player {
+		case WhitePlayer.String():
+			publicKey = verification.WhitePublicKey
+		case BlackPlayer.String():
+			publicKey = verification.BlackPublicKey
+		}
+		result.Signed = publicKey != "" && action.Signature != ""
+		result.Valid = result.Signed && verifySignature(publicKey, gameID, action) == nil
+		verification.Verified = verification.Verified && result.Valid
+		verification.Actions = append(verification.Actions, result)
+	}
+	return &verification, rows.Err()
+}
+
+// verifyGameHandler serves GET prefix/{id}/verify, which checks the signatures of all the actions of the game.
+// Private games require a token in the "token" query parameter.
+func verifyGameHandler(w http.ResponseWriter, r *http.Request, gameID int) {
+	game, err := GetGameWithId(gameID)
+	if err != nil {
+		sendError(w, serverError("cannot find game", err))
+		return
+	}
+	if !canWatch(r, game) {
+		sendError(w, serverError("invalid token", nil))
+		return
+	}
+	verification, err := verifyGame(gameID)
+	if err != nil {
+		sendError(w, serverError("cannot verify game", err))
+		return
+	}
+	writeJSONResponse(w, verification)
+}
@@ -0,0 +1,124 @@
+package gameserver_test
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/vkryukov/gameserver"
+)
+
+func mustGenerateKey(t *testing.T) (string, ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(publicKey), privateKey
+}
+
+func mustVerifyGame(t *testing.T, gameID int) *gameserver.GameVerification {
+	resp, err := http.Get(fmt.Sprintf("http://localhost:1234/game/%d/verify", gameID))
+	if err != nil {
+		t.Fatalf("Failed to verify game: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	var verification gameserver.GameVerification
+	if err := json.Unmarshal(body, &verification); err != nil {
+		t.Fatalf("Failed to unmarshal response %q: %v", body, err)
+	}
+	return &verification
+}
+
+func TestSignedActions(t *testing.T) {
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	whiteKey, whitePrivateKey := mustGenerateKey(t)
+	blackKey, blackPrivateKey := mustGenerateKey(t)
+
+	// Test 1: keys are registered when creating and joining a game, and only for taken seats
+	_, err := gameserver.CreateGame(&gameserver.Game{Type: "Gipf", WhitePlayer: user1.ScreenName, WhiteToken: user1.Token,
+		Public: true, BlackPublicKey: blackKey})
+	if err == nil {
+		t.Fatalf("Expected a key for the empty seat to be rejected")
+	}
+	game, err := gameserver.CreateGame(&gameserver.Game{Type: "Gipf", WhitePlayer: user1.ScreenName, WhiteToken: user1.Token,
+		Public: true, WhitePublicKey: whiteKey})
+	if err != nil {
+		t.Fatalf("Failed to create game: %v", err)
+	}
+	resp := postObject(t, "http://localhost:1234/game/join", map[string]interface{}{"id": game.Id, "token": user2.Token, "public_key": "invalid"})
+	if !isErrorResponse(resp, "invalid public key") {
+		t.Fatalf("Expected an invalid key error, got %s", resp)
+	}
+	var joined gameserver.Game
+	mustDecodeRequestWithObject(t, "http://localhost:1234/game/join", map[string]interface{}{"id": game.Id, "token": user2.Token, "public_key": blackKey}, &joined)
+	if joined.WhitePublicKey != whiteKey || joined.BlackPublicKey != blackKey {
+		t.Fatalf("Unexpected keys: %s", mustPrettyPrint(t, joined))
+	}
+
+	url := fmt.Sprintf("http://localhost:1234/game/%d/actions", game.Id)
+	makeAction := func(token gameserver.Token, num int, move string, signature string) gameserver.ErrorCode {
+		var resp struct {
+			Error     string               `json:"error"`
+			ErrorCode gameserver.ErrorCode `json:"error_code"`
+		}
+		mustDecodeRequestWithObject(t, url, map[string]interface{}{"token": token, "action_num": num, "action": move, "signature": signature}, &resp)
+		return resp.ErrorCode
+	}
+
+	// Test 2: actions must be signed with the key of the player who makes them
+	if code := makeAction(user1.Token, 1, "a", gameserver.SignAction(whitePrivateKey, game.Id, 1, "a")); code != "" {
+		t.Fatalf("Expected a signed action to be accepted, got %q", code)
+	}
+	if code := makeAction(user2.Token, 2, "b", ""); code != gameserver.ErrorInvalidSignature {
+		t.Fatalf("Expected an unsigned action to be rejected, got %q", code)
+	}
+	if code := makeAction(user2.Token, 2, "b", gameserver.SignAction(whitePrivateKey, game.Id, 2, "b")); code != gameserver.ErrorInvalidSignature {
+		t.Fatalf("Expected an action signed with another key to be rejected, got %q", code)
+	}
+	if code := makeAction(user2.Token, 2, "b", gameserver.SignAction(blackPrivateKey, game.Id, 2, "c")); code != gameserver.ErrorInvalidSignature {
+		t.Fatalf("Expected an action signed for another move to be rejected, got %q", code)
+	}
+	if code := makeAction(user2.Token, 2, "b", gameserver.SignAction(blackPrivateKey, game.Id, 2, "b")); code != "" {
+		t.Fatalf("Expected a signed action to be accepted, got %q", code)
+	}
+
+	// Test 3: anyone can verify the record
+	verification := mustVerifyGame(t, game.Id)
+	if !verification.Verified || len(verification.Actions) != 2 || verification.Actions[1].Player != "black" {
+		t.Fatalf("Unexpected verification: %s", mustPrettyPrint(t, verification))
+	}
+
+	// Test 4: games with unsigned actions are not verified
+	game2 := mustCreateGame(t, user1, true, true)
+	mustJoinGame(t, user2, game2)
+	if err := gameserver.ExecuteSQL("INSERT INTO actions(game_id, action_num, action, player) VALUES(?, 1, 'a', 'white')", game2.Id); err != nil {
+		t.Fatalf("Failed to insert action: %v", err)
+	}
+	if verification := mustVerifyGame(t, game2.Id); verification.Verified || verification.Actions[0].Signed {
+		t.Fatalf("Unexpected verification: %s", mustPrettyPrint(t, verification))
+	}
+
+	// Test 5: the keys of the players are sealed with the record
+	conn := mustDialWS(t)
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, conn, "GameJoined")
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "GameOver", Message: "Draw"})
+	mustReadWSMessageOfType(t, conn, "GameOver")
+	bundle, err := gameserver.ExportRecord(game.Id)
+	if err != nil {
+		t.Fatalf("Failed to export record: %v", err)
+	}
+	if err := gameserver.VerifyRecord(bundle, nil); err != nil {
+		t.Fatalf("Expected the record to be verified, got %v", err)
+	}
+	bundle.WhitePublicKey = ""
+	if err := gameserver.VerifyRecord(bundle, nil); err == nil {
+		t.Fatalf("Expected the record without the key of white to fail verification")
+	}
+}
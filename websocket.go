@@ -1,29 +1,201 @@
 package gameserver
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// WebSocketConfig controls how the server manages WebSocket connections.
+type WebSocketConfig struct {
+	// SendBufferSize is the number of outgoing messages that can be queued for a connection. A connection whose
+	// queue is full has fallen too far behind and is dropped.
+	SendBufferSize int
+	// WriteTimeout is the maximum time a single write to a connection may take.
+	WriteTimeout time.Duration
+	// HubIdleTimeout is how long a game's hub keeps running without any connections.
+	HubIdleTimeout time.Duration
+	// PingInterval is how often the server pings each connection; 0 disables pings.
+	PingInterval time.Duration
+	// PongTimeout is how long a connection may stay silent, without answering pings or sending messages,
+	// before it is considered dead; 0 disables the timeout.
+	PongTimeout time.Duration
+	// MaxMessageSize is the maximum size in bytes of an incoming message; 0 means no limit.
+	MaxMessageSize int64
+	// MaxMessagesPerSecond and MessageBurst limit the rate of incoming messages on each connection;
+	// a MaxMessagesPerSecond of 0 disables rate limiting.
+	MaxMessagesPerSecond float64
+	MessageBurst         int
+}
+
+func DefaultWebSocketConfig() WebSocketConfig {
+	return WebSocketConfig{
+		SendBufferSize:       64,
+		WriteTimeout:         10 * time.Second,
+		HubIdleTimeout:       time.Minute,
+		PingInterval:         30 * time.Second,
+		PongTimeout:          60 * time.Second,
+		MaxMessageSize:       64 * 1024,
+		MaxMessagesPerSecond: 20,
+		MessageBurst:         40,
+	}
+}
+
+var (
+	_webSocketConfig   = DefaultWebSocketConfig()
+	_webSocketConfigMu sync.RWMutex
+)
+
+// SetWebSocketConfig sets the configuration of the connections opened from now on.
+func SetWebSocketConfig(config WebSocketConfig) {
+	_webSocketConfigMu.Lock()
+	defer _webSocketConfigMu.Unlock()
+	_webSocketConfig = config
+}
+
+func getWebSocketConfig() WebSocketConfig {
+	_webSocketConfigMu.RLock()
+	defer _webSocketConfigMu.RUnlock()
+	return _webSocketConfig
+}
+
+// Conn is a WebSocket connection with its own queue of outgoing messages. Messages are only ever written to the
+// underlying connection by the connection's writer goroutine, so that a slow client cannot block anyone else.
 type Conn struct {
 	*websocket.Conn
+	*outbox
+}
+
+type outbox struct {
+	messages  chan WebSocketMessage
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// games is the set of games the connection has joined.
+	games   map[int]bool
+	gamesMu sync.Mutex
+
+	protocol protocol
+	// config is the configuration of the server the connection was opened with.
+	config WebSocketConfig
+}
+
+var errConnectionClosed = errors.New("connection is closed")
+
+func newConn(c *websocket.Conn, protocol protocol, config WebSocketConfig) Conn {
+	conn := Conn{c, newOutbox(protocol, config)}
+	go conn.writeMessages()
+	return conn
+}
+
+// newStreamConn returns a connection that is not backed by a WebSocket. Messages sent to it are only queued,
+// and it is up to the caller to deliver them.
+func newStreamConn() Conn {
+	return Conn{nil, newOutbox(protocolV1, getWebSocketConfig())}
+}
+
+func newOutbox(protocol protocol, config WebSocketConfig) *outbox {
+	return &outbox{
+		messages: make(chan WebSocketMessage, config.SendBufferSize),
+		closed:   make(chan struct{}),
+		games:    make(map[int]bool),
+		protocol: protocol,
+		config:   config,
+	}
 }
 
 func (c Conn) String() string {
 	return fmt.Sprintf("%s%p%s", blueColor, c.Conn, resetColor)
 }
 
-var (
-	connectedUsers   = make(map[int][]Conn)
-	connectedUsersMu sync.Mutex
-)
+// Send queues the message for writing without blocking. If the connection's queue is full, the connection is closed.
+func (c Conn) Send(message WebSocketMessage) error {
+	select {
+	case <-c.closed:
+		return errConnectionClosed
+	default:
+	}
+	select {
+	case c.messages <- message:
+		return nil
+	default:
+		log.Printf("Dropping connection %s: too many pending messages", c)
+		c.Close()
+		return fmt.Errorf("connection %s has fallen behind", c)
+	}
+}
+
+// Close stops the writer goroutine and closes the underlying connection. It is safe to call it more than once.
+func (c Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.Conn != nil {
+			err = c.Conn.Close()
+		}
+	})
+	return err
+}
+
+func (c Conn) joinedGame(gameID int) {
+	c.gamesMu.Lock()
+	defer c.gamesMu.Unlock()
+	c.games[gameID] = true
+}
+
+// joinedGames returns the ids of the games the connection has joined.
+func (c Conn) joinedGames() []int {
+	c.gamesMu.Lock()
+	defer c.gamesMu.Unlock()
+	gameIDs := make([]int, 0, len(c.games))
+	for gameID := range c.games {
+		gameIDs = append(gameIDs, gameID)
+	}
+	return gameIDs
+}
+
+func (c Conn) writeMessages() {
+	var ping <-chan time.Time
+	if c.config.PingInterval > 0 {
+		ticker := time.NewTicker(c.config.PingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	for {
+		select {
+		case <-ping:
+			if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.config.WriteTimeout)); err != nil {
+				log.Printf("Error pinging %s: %v", c, err)
+				c.Close()
+				return
+			}
+		case message := <-c.messages:
+			messageType, data, err := c.protocol.encode(message)
+			if err != nil {
+				log.Printf("Error encoding message for %s: %v", c, err)
+				continue
+			}
+			c.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+			if err := c.WriteMessage(messageType, data); err != nil {
+				log.Printf("Error writing to %s: %v", c, err)
+				c.Close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
 
 var upgrader = websocket.Upgrader{
+	Subprotocols: []string{subprotocolMsgPack, subprotocolV2, subprotocolV1},
 	CheckOrigin: func(r *http.Request) bool {
 		// Allow connections with a null origin (for local file testing)
 		origin := r.Header.Get("Origin")
@@ -36,48 +208,92 @@ type WebSocketMessage struct {
 	Token   Token  `json:"token"`
 	Type    string `json:"message_type,omitempty"`
 	Message string `json:"message,omitempty"`
+	// Seq is the position of a broadcast message in its game's stream, assigned by the server.
+	// It is 0 for messages sent to a single connection.
+	Seq int `json:"seq,omitempty"`
+	// RequestID is chosen by the client, and echoed in the server's replies to the request.
+	RequestID string `json:"request_id,omitempty"`
+	// ErrorCode is the machine-readable reason of an "Error" message.
+	ErrorCode ErrorCode `json:"error_code,omitempty"`
+	// Payload is the JSON value of Message, for messages whose content is JSON. Protocol v1 only sends Message,
+	// while the other protocols send Payload as a value, and Message as a string when there is no Payload.
+	Payload json.RawMessage `json:"-"`
 }
 
-// TODO: add logging for websocket connections
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	serveWebSocket(w, r, getWebSocketConfig())
+}
+
+// NewWebSocketHandler returns a handler of WebSocket connections that uses the given configuration instead of the one
+// set with SetWebSocketConfig.
+func NewWebSocketHandler(config WebSocketConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveWebSocket(w, r, config)
+	}
+}
+
+// TODO: add logging for websocket connections
+func serveWebSocket(w http.ResponseWriter, r *http.Request, config WebSocketConfig) {
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Failed to upgrade the connection: %v", err)
 		return
 	}
-	conn := Conn{c}
+	conn := newConn(c, negotiateProtocol(r, c.Subprotocol()), config)
 	go listenForWebSocketMessages(conn)
 }
 
 // TODO: add error logging for websocket connections
 func listenForWebSocketMessages(conn Conn) {
 	defer conn.Close()
+	lobbyConnectionOpened(conn)
+	defer lobbyConnectionClosed(conn)
+	defer removeConnection(conn)
 
+	conn.setupReading()
+	limiter := newRateLimiter(conn.config.MaxMessagesPerSecond, conn.config.MessageBurst)
 	for {
 		messageType, messageData, err := conn.ReadMessage()
 		if err != nil {
 			log.Printf("Error reading message: %v", err)
+			if isTimeout(err) {
+				conn.closeWithReason(websocket.CloseGoingAway, "connection timed out")
+			}
+			return
+		}
+		conn.extendReadDeadline()
+		if !limiter.allow() {
+			log.Printf("Rate limit exceeded for %s", conn)
+			conn.closeWithReason(websocket.ClosePolicyViolation, "rate limit exceeded")
 			return
 		}
 
-		switch messageType {
-		case websocket.TextMessage:
-			var message WebSocketMessage
-			err := json.Unmarshal(messageData, &message)
-			if err != nil {
-				log.Printf("Error unmarshalling message for %s: %v", conn, err)
-				return
+		if messageType != conn.protocol.messageType() {
+			kind := "binary"
+			if messageType == websocket.TextMessage {
+				kind = "text"
 			}
-			playerType, token := validateGameToken(message.GameID, message.Token)
-			if playerType == InvalidPlayer {
-				log.Printf("Invalid game id or token for %s: %d %s", conn, message.GameID, message.Token)
-				return
-			}
-			processMessage(conn, message, playerType, token)
-		case websocket.BinaryMessage:
-			log.Printf("Error: received non-supported binary message %s", messageData)
+			log.Printf("Error: received non-supported %s message %s", kind, messageData)
+			conn.closeWithReason(websocket.CloseUnsupportedData, kind+" messages are not supported")
 			return
 		}
+		message, err := conn.protocol.decode(messageData)
+		if err != nil {
+			log.Printf("Error unmarshalling message for %s: %v", conn, err)
+			conn.closeWithReason(websocket.CloseInvalidFramePayloadData, "invalid message")
+			return
+		}
+		if isLobbyMessage(message.Type) {
+			processLobbyMessage(conn, message)
+			continue
+		}
+		playerType, token := validateGameToken(message.GameID, message.Token)
+		if playerType == InvalidPlayer {
+			log.Printf("Invalid game id or token for %s: %d %s", conn, message.GameID, message.Token)
+			conn.closeWithReason(websocket.ClosePolicyViolation, "invalid game id or token")
+			return
+		}
+		processMessage(conn, message, playerType, token)
 	}
 }
 
@@ -85,21 +301,30 @@ func processMessage(conn Conn, message WebSocketMessage, playerType PlayerType,
 	switch message.Type {
 	case "Join":
 		game, err := GetGameWithId(message.GameID)
-		if handleError(conn, message.GameID, err) {
+		if handleError(conn, message, err) {
 			return
 		}
-		actions, err := getAllActions(message.GameID)
-		if handleError(conn, message.GameID, err) {
+		joined, err := joinAndCatchUp(message.GameID, conn, playerType, 0, 0)
+		if handleError(conn, message, err) {
+			return
+		}
+		if joined.isNew {
+			playerConnected(conn, message.GameID, playerType)
+		}
+		lobbyPlayerIdentified(conn, message.GameID, playerType)
+		presence, err := getPresence(message.GameID)
+		if handleError(conn, message, err) {
 			return
 		}
-		addConnection(message.GameID, conn)
-		sendJSONMessage(conn, message.GameID, "GameJoined", map[string]interface{}{
+		sendReply(conn, message, "GameJoined", map[string]interface{}{
 			"player":       playerType.String(),
 			"game_token":   token,
 			"white_player": game.WhitePlayer,
 			"black_player": game.BlackPlayer,
-			"actions":      actions,
+			"actions":      joined.actions,
 			"game_type":    game.Type,
+			"presence":     presence,
+			"seq":          joined.seq,
 		})
 
 	case "Action":
@@ -107,70 +332,132 @@ func processMessage(conn Conn, message WebSocketMessage, playerType PlayerType,
 		err := json.Unmarshal([]byte(message.Message), &action)
 		if err != nil {
 			log.Printf("Error unmarshalling action message: %v", err)
+			handleError(conn, message, newCodedError(ErrorInvalidMessage, "invalid action: %v", err))
 			return
 		}
-		if handleError(conn, message.GameID, checkGameStatus(message.GameID)) {
-			log.Printf("Game %d is not in progress", message.GameID)
+		duplicate, err := appendAction(message.GameID, playerType, action)
+		if handleError(conn, message, err) {
+			log.Printf("Action %d for game %d was not saved: %v", action.ActionNum, message.GameID, err)
 			return
 		}
-		if handleError(conn, message.GameID, checkActionValidity(message.GameID, action.ActionNum)) {
-			log.Printf("Invalid action number %d for game %d", action.ActionNum, message.GameID)
+		if duplicate {
+			sendReply(conn, message, "ActionAccepted", map[string]interface{}{"action_num": action.ActionNum, "duplicate": true})
 			return
 		}
-		// Save the action to the database
-		if err := saveAction(message.GameID, action.ActionNum, action.Action, action.Signature); handleError(conn, message.GameID, err) {
-			log.Printf("Error saving action: %v", err)
+		broadcastMessage := message
+		broadcastMessage.RequestID = ""
+		// The action has been parsed, so its content is known to be JSON even if the sender used protocol v1.
+		broadcastMessage.Payload = json.RawMessage(message.Message)
+		broadcast(message.GameID, broadcastMessage)
+		sendReply(conn, message, "ActionAccepted", map[string]int{"action_num": action.ActionNum})
+
+	case "Resume":
+		var request resumeRequest
+		err := json.Unmarshal([]byte(message.Message), &request)
+		if err != nil {
+			handleError(conn, message, newCodedError(ErrorInvalidMessage, "invalid resume request: %v", err))
+			return
+		}
+		resumeGame(conn, message, playerType, token, request)
+
+	case "Retransmit":
+		var request retransmitRequest
+		err := json.Unmarshal([]byte(message.Message), &request)
+		if err != nil {
+			handleError(conn, message, newCodedError(ErrorInvalidMessage, "invalid retransmit request: %v", err))
 			return
 		}
-		broadcast(message.GameID, message)
+		retransmit(conn, message, request.FromSeq)
 
 	case "SendFullGame":
-		if allActions, err := getAllActions(message.GameID); handleError(conn, message.GameID, err) {
+		if allActions, err := getAllActions(message.GameID); handleError(conn, message, err) {
 			return
 		} else {
-			sendJSONMessage(conn, message.GameID, "FullGame", allActions)
+			sendReply(conn, message, "FullGame", allActions)
 		}
 
 	case "RejectAction":
-		broadcast(message.GameID, WebSocketMessage{GameID: message.GameID, Type: "GameOver", Message: "Rejected action"})
-		if err := markGameAsFinished(message.GameID, "Rejected action detected"); err != nil {
-			log.Printf("Error marking game as finished: %v", err)
+		if handleError(conn, message, markGameAsFinished(message.GameID, "Rejected action detected")) {
+			return
 		}
+		broadcast(message.GameID, WebSocketMessage{GameID: message.GameID, Type: "GameOver", Message: "Rejected action"})
 		return
 
 	case "GameOver":
+		if handleError(conn, message, markGameAsFinished(message.GameID, message.Message)) {
+			return
+		}
 		broadcast(message.GameID, WebSocketMessage{GameID: message.GameID, Type: "GameOver", Message: message.Message})
-		if err := markGameAsFinished(message.GameID, message.Message); err != nil {
-			log.Printf("Error marking game as finished: %v", err)
+
+	case "ClaimVictory":
+		result, err := claimAbandonment(message.GameID, playerType)
+		if handleError(conn, message, err) {
+			return
 		}
+		broadcast(message.GameID, WebSocketMessage{GameID: message.GameID, Type: "GameOver", Message: result})
+
+	case "Replay":
+		var request replayRequest
+		if message.Message != "" {
+			if err := json.Unmarshal([]byte(message.Message), &request); err != nil {
+				handleError(conn, message, newCodedError(ErrorInvalidMessage, "invalid replay request: %v", err))
+				return
+			}
+		}
+		replayGame(conn, message, request)
+
+	case "Rematch":
+		newGame, err := requestRematch(message.GameID, playerType)
+		if handleError(conn, message, err) {
+			return
+		}
+		notifyRematch(conn, message, playerType, newGame)
 
 	default:
-		sendJSONMessage(conn, message.GameID, "Error", fmt.Sprintf("Unknown message type %s", message.Type))
+		handleError(conn, message, newCodedError(ErrorUnknownMessageType, "Unknown message type %s", message.Type))
 	}
 }
 
-func addConnection(gameID int, conn Conn) {
-	connectedUsersMu.Lock()
-	connectedUsers[gameID] = append(connectedUsers[gameID], conn)
-	connectedUsersMu.Unlock()
-}
-
-// handleError checks if there is an error and sends an appropriate JSON message. Returns true if there was an error.
-func handleError(conn Conn, gameID int, err error) bool {
+// handleError checks if there is an error and sends an appropriate JSON message in reply to the request,
+// with the error's code. Returns true if there was an error.
+func handleError(conn Conn, request WebSocketMessage, err error) bool {
 	if err != nil {
-		sendJSONMessage(conn, gameID, "Error", err.Error())
+		message, jsonErr := newJSONMessage(request.GameID, "Error", err.Error())
+		if jsonErr != nil {
+			return true
+		}
+		message.RequestID = request.RequestID
+		message.ErrorCode = errorCode(err)
+		if err := conn.Send(message); err != nil {
+			log.Printf("Error sending error message: %v", err)
+		}
 		return true
 	}
 	return false
 }
 
-func sendJSONMessage(conn Conn, gameId int, messageType string, data any) error {
+// newJSONMessage creates a message of the given type whose content is the JSON encoding of data.
+func newJSONMessage(gameId int, messageType string, data any) (WebSocketMessage, error) {
 	prettyJson, err := json.MarshalIndent(data, "", "  ")
 	if err != nil {
 		log.Printf("Error marshalling JSON: %v", err)
+		return WebSocketMessage{}, err
+	}
+	var payload bytes.Buffer
+	if err := json.Compact(&payload, prettyJson); err != nil {
+		return WebSocketMessage{}, err
+	}
+	return WebSocketMessage{GameID: gameId, Type: messageType, Message: string(prettyJson), Payload: payload.Bytes()}, nil
+}
+
+// sendReply sends a message of the given type in reply to the request.
+func sendReply(conn Conn, request WebSocketMessage, messageType string, data any) error {
+	message, err := newJSONMessage(request.GameID, messageType, data)
+	if err != nil {
 		return err
 	}
-	err = conn.WriteJSON(WebSocketMessage{GameID: gameId, Type: messageType, Message: string(prettyJson)})
+	message.RequestID = request.RequestID
+	err = conn.Send(message)
 	if err != nil {
 		log.Printf("Error sending JSON message: %v", err)
 		return err
@@ -178,25 +465,15 @@ func sendJSONMessage(conn Conn, gameId int, messageType string, data any) error
 	return nil
 }
 
-func broadcast(gameID int, action WebSocketMessage) {
-	connectedUsersMu.Lock()
-	defer connectedUsersMu.Unlock()
-
-	var activeConnections []Conn
-
-	for _, conn := range connectedUsers[gameID] {
-		err := conn.WriteJSON(action)
-		if err != nil {
-			log.Printf("Failed to send action to conn %s: %v", conn, err)
-			conn.Close() // Close the failed connection
-		} else {
-			activeConnections = append(activeConnections, conn)
-		}
+func sendJSONMessage(conn Conn, gameId int, messageType string, data any) error {
+	message, err := newJSONMessage(gameId, messageType, data)
+	if err != nil {
+		return err
 	}
-
-	connectedUsers[gameID] = activeConnections
-
-	if len(connectedUsers[gameID]) == 0 {
-		delete(connectedUsers, gameID)
+	err = conn.Send(message)
+	if err != nil {
+		log.Printf("Error sending JSON message: %v", err)
+		return err
 	}
+	return nil
 }
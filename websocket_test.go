@@ -2,10 +2,18 @@ package gameserver_test
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/vkryukov/gameserver"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 func mustSendWSMessage(t *testing.T, wsm *gameserver.WebSocketMessage) {
@@ -35,7 +43,7 @@ func mustReadWSMessage(t *testing.T) *gameserver.WebSocketMessage {
 	return &wsm
 }
 
-// mustMakeAction sends a move and returns both the immediate response and the broadcasted response
+// mustMakeAction sends a move, checks that it has been accepted, and returns the broadcasted response
 func mustMakeAction(t *testing.T, user *gameserver.User, game *gameserver.Game, move string, num int) *gameserver.WebSocketMessage {
 	action := &gameserver.Action{ActionNum: num, Action: move}
 	data, err := json.Marshal(action)
@@ -47,6 +55,9 @@ func mustMakeAction(t *testing.T, user *gameserver.User, game *gameserver.Game,
 	if r1.Type == "Error" {
 		t.Fatalf("Received error message: %v", r1.Message)
 	}
+	if ack := mustReadWSMessage(t); ack.Type != "ActionAccepted" {
+		t.Fatalf("Expected ActionAccepted, got %v", ack.Type)
+	}
 	return r1
 }
 
@@ -106,3 +117,821 @@ func TestJoiningNewGame(t *testing.T) {
 		t.Fatalf("Expected game record 'a b', got '%s'", game.GameRecord)
 	}
 }
+
+// mustDialWS opens a new WebSocket connection that is closed at the end of the test.
+func mustDialWS(t *testing.T) *websocket.Conn {
+	u := url.URL{Scheme: "ws", Host: "localhost:1234", Path: "/game/ws"}
+	return mustDialWSURL(t, u.String())
+}
+
+func mustDialWSURL(t *testing.T, address string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(address, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// startWSServer starts a server of WebSocket connections with the given configuration, and returns its URL.
+func startWSServer(t *testing.T, config gameserver.WebSocketConfig) string {
+	server := httptest.NewServer(gameserver.NewWebSocketHandler(config))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func mustSendWSMessageTo(t *testing.T, conn *websocket.Conn, wsm *gameserver.WebSocketMessage) {
+	if err := conn.WriteJSON(wsm); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+// mustReadWSMessageOfType reads messages from the connection, skipping messages of other types,
+// until it finds one of the given type.
+func mustReadWSMessageOfType(t *testing.T, conn *websocket.Conn, messageType string) *gameserver.WebSocketMessage {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		var wsm gameserver.WebSocketMessage
+		if err := conn.ReadJSON(&wsm); err != nil {
+			t.Fatalf("Failed to read %s message: %v", messageType, err)
+		}
+		if wsm.Type == messageType {
+			return &wsm
+		}
+	}
+}
+
+func TestLobby(t *testing.T) {
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	lobby := mustDialWS(t)
+
+	mustSendWSMessageTo(t, lobby, &gameserver.WebSocketMessage{Type: "SubscribeLobby"})
+	var snapshot gameserver.LobbySnapshot
+	if err := json.Unmarshal([]byte(mustReadWSMessageOfType(t, lobby, "Lobby").Message), &snapshot); err != nil {
+		t.Fatalf("Failed to unmarshal lobby snapshot: %v", err)
+	}
+	if snapshot.Online < 1 {
+		t.Fatalf("Expected at least one online connection, got %d", snapshot.Online)
+	}
+
+	// Test 1: creating a public game announces a seek without player tokens
+	game := mustCreateGame(t, user1, true, true)
+	var seek gameserver.Game
+	if err := json.Unmarshal([]byte(mustReadWSMessageOfType(t, lobby, "SeekCreated").Message), &seek); err != nil {
+		t.Fatalf("Failed to unmarshal seek: %v", err)
+	}
+	if seek.Id != game.Id || seek.WhitePlayer != user1.ScreenName || seek.WhiteToken != "" {
+		t.Fatalf("Unexpected seek: %s", mustPrettyPrint(t, seek))
+	}
+
+	// Test 2: joining the seek announces it
+	mustJoinGame(t, user2, game)
+	content := mustExtractMessage(t, mustReadWSMessageOfType(t, lobby, "SeekJoined"))
+	if content["id"] != float64(game.Id) || content["black_player"] != user2.ScreenName {
+		t.Fatalf("Unexpected joined seek: %s", mustPrettyPrint(t, content))
+	}
+
+	// Test 3: cancelling a seek announces it
+	game2 := mustCreateGame(t, user2, false, true)
+	mustReadWSMessageOfType(t, lobby, "SeekCreated")
+	postObject(t, "http://localhost:1234/game/cancel", map[string]interface{}{"id": game2.Id, "token": user2.Token})
+	content = mustExtractMessage(t, mustReadWSMessageOfType(t, lobby, "SeekCancelled"))
+	if content["id"] != float64(game2.Id) {
+		t.Fatalf("Unexpected cancelled seek: %s", mustPrettyPrint(t, content))
+	}
+
+	// Test 4: opening another connection updates the online count
+	mustDialWS(t)
+	content = mustExtractMessage(t, mustReadWSMessageOfType(t, lobby, "OnlineUsers"))
+	if content["online"].(float64) < 2 {
+		t.Fatalf("Expected at least two online connections, got %v", content["online"])
+	}
+
+	// Test 5: a user with two connections is counted once
+	conn1 := mustDialWS(t)
+	mustReadWSMessageOfType(t, lobby, "OnlineUsers")
+	mustSendWSMessageTo(t, conn1, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, conn1, "GameJoined")
+	conn2 := mustDialWS(t)
+	online := mustExtractMessage(t, mustReadWSMessageOfType(t, lobby, "OnlineUsers"))["online"].(float64)
+	mustSendWSMessageTo(t, conn2, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Join"})
+	content = mustExtractMessage(t, mustReadWSMessageOfType(t, lobby, "OnlineUsers"))
+	if content["online"].(float64) != online-1 {
+		t.Fatalf("Expected %v users online, got %v", online-1, content["online"])
+	}
+}
+
+func TestPresence(t *testing.T) {
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user1, true, true)
+	mustJoinGame(t, user2, game)
+	conn1 := mustDialWS(t)
+	conn2 := mustDialWS(t)
+
+	mustSendWSMessageTo(t, conn1, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, conn1, "GameJoined")
+
+	// Test 1: the opponent learns about the new connection, and the joining player sees who is present
+	mustSendWSMessageTo(t, conn2, &gameserver.WebSocketMessage{GameID: game.Id, Token: user2.Token, Type: "Join"})
+	content := mustExtractMessage(t, mustReadWSMessageOfType(t, conn1, "PlayerConnected"))
+	if content["player"] != "black" {
+		t.Fatalf("Expected black player to connect, got %s", mustPrettyPrint(t, content))
+	}
+	content = mustExtractMessage(t, mustReadWSMessageOfType(t, conn2, "GameJoined"))
+	presence := content["presence"].(map[string]interface{})
+	if presence["white"] != true || presence["black"] != true {
+		t.Fatalf("Expected both players to be present, got %s", mustPrettyPrint(t, presence))
+	}
+
+	// Test 2: closing the connection is announced and recorded
+	conn2.Close()
+	content = mustExtractMessage(t, mustReadWSMessageOfType(t, conn1, "PlayerDisconnected"))
+	if content["player"] != "black" {
+		t.Fatalf("Expected black player to disconnect, got %s", mustPrettyPrint(t, content))
+	}
+	var p gameserver.Presence
+	mustDecodeRequestWithObject(t, "http://localhost:1234/game/presence", map[string]interface{}{
+		"id":    game.Id,
+		"token": user1.Token,
+	}, &p)
+	if !p.White || p.Black || p.BlackLastSeen == 0 {
+		t.Fatalf("Unexpected presence after disconnection: %s", mustPrettyPrint(t, p))
+	}
+}
+
+func TestAbandonment(t *testing.T) {
+	gameserver.SetAbandonmentConfig(200*time.Millisecond, 1)
+	defer gameserver.SetAbandonmentConfig(2*time.Minute, 2)
+
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user1, true, true)
+	mustJoinGame(t, user2, game)
+	conn1 := mustDialWS(t)
+	conn2 := mustDialWS(t)
+	mustSendWSMessageTo(t, conn1, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, conn1, "GameJoined")
+	mustSendWSMessageTo(t, conn2, &gameserver.WebSocketMessage{GameID: game.Id, Token: user2.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, conn2, "GameJoined")
+	action, _ := json.Marshal(&gameserver.Action{ActionNum: 1, Action: "a"})
+	mustSendWSMessageTo(t, conn1, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Action", Message: string(action)})
+	mustReadWSMessageOfType(t, conn1, "Action")
+
+	// Test 1: cannot claim victory while the opponent is connected
+	mustSendWSMessageTo(t, conn1, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "ClaimVictory"})
+	resp := mustReadWSMessageOfType(t, conn1, "Error")
+	if resp.Message == "" {
+		t.Fatalf("Expected an error when claiming victory over a connected player")
+	}
+
+	// Test 2: cannot claim victory before the grace period expires
+	conn2.Close()
+	mustReadWSMessageOfType(t, conn1, "PlayerDisconnected")
+	mustSendWSMessageTo(t, conn1, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "ClaimVictory"})
+	mustReadWSMessageOfType(t, conn1, "Error")
+
+	// Test 3: after the grace period, the opponent is notified and the claim wins the game
+	content := mustExtractMessage(t, mustReadWSMessageOfType(t, conn1, "OpponentAbandoned"))
+	if content["player"] != "black" {
+		t.Fatalf("Expected black player to have abandoned the game, got %s", mustPrettyPrint(t, content))
+	}
+	mustSendWSMessageTo(t, conn1, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "ClaimVictory"})
+	resp = mustReadWSMessageOfType(t, conn1, "GameOver")
+	if resp.Message != "Game won by white: black abandoned the game" {
+		t.Fatalf("Unexpected game result: %q", resp.Message)
+	}
+	finished, err := gameserver.GetGameWithId(game.Id)
+	if err != nil {
+		t.Fatalf("Failed to get game: %v", err)
+	}
+	if !finished.GameOver || finished.GameResult != resp.Message {
+		t.Fatalf("Game was not finished correctly: %s", mustPrettyPrint(t, finished))
+	}
+}
+
+func TestResume(t *testing.T) {
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user1, true, true)
+	mustJoinGame(t, user2, game)
+	conn1 := mustDialWS(t)
+	mustSendWSMessageTo(t, conn1, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, conn1, "GameJoined")
+
+	// Test 1: broadcasts have increasing sequence numbers
+	var lastSeq int
+	for i, move := range []string{"a", "b", "c"} {
+		token := user1.Token
+		if i%2 == 1 {
+			token = user2.Token
+		}
+		action, _ := json.Marshal(&gameserver.Action{ActionNum: i + 1, Action: move})
+		mustSendWSMessageTo(t, conn1, &gameserver.WebSocketMessage{GameID: game.Id, Token: token, Type: "Action", Message: string(action)})
+		resp := mustReadWSMessageOfType(t, conn1, "Action")
+		if resp.Seq <= lastSeq {
+			t.Fatalf("Expected sequence number greater than %d, got %d", lastSeq, resp.Seq)
+		}
+		lastSeq = resp.Seq
+	}
+
+	// Test 2: resuming returns only the missing actions
+	conn2 := mustDialWS(t)
+	mustSendWSMessageTo(t, conn2, &gameserver.WebSocketMessage{GameID: game.Id, Token: user2.Token, Type: "Resume",
+		Message: `{"last_action": 1, "last_seq": 1}`})
+	var resumed struct {
+		Actions        []gameserver.Action `json:"actions"`
+		Seq            int                 `json:"seq"`
+		EventsComplete bool                `json:"events_complete"`
+	}
+	if err := json.Unmarshal([]byte(mustReadWSMessageOfType(t, conn2, "Resumed").Message), &resumed); err != nil {
+		t.Fatalf("Failed to unmarshal resumed message: %v", err)
+	}
+	if len(resumed.Actions) != 2 || resumed.Actions[0].Action != "b" || resumed.Actions[1].Action != "c" {
+		t.Fatalf("Expected actions b and c, got %s", mustPrettyPrint(t, resumed.Actions))
+	}
+	if !resumed.EventsComplete || resumed.Seq < lastSeq {
+		t.Fatalf("Unexpected resume state: %s", mustPrettyPrint(t, resumed))
+	}
+
+	// Test 3: missing broadcasts can be retransmitted
+	mustSendWSMessageTo(t, conn2, &gameserver.WebSocketMessage{GameID: game.Id, Token: user2.Token, Type: "Retransmit",
+		Message: `{"from_seq": 1}`})
+	resp := mustReadWSMessageOfType(t, conn2, "Action")
+	if resp.Seq != 2 {
+		t.Fatalf("Expected retransmitted message with sequence number 2, got %d", resp.Seq)
+	}
+}
+
+func TestGameHubs(t *testing.T) {
+	config := gameserver.DefaultWebSocketConfig()
+	config.HubIdleTimeout = 100 * time.Millisecond
+	server := startWSServer(t, config)
+
+	user := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user, true, true)
+	conn := mustDialWSURL(t, server)
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, conn, "GameJoined")
+
+	// Test 1: the game's hub counts its connection
+	stats := gameserver.GetConnectionStats()
+	if stats.Games[game.Id] != 1 {
+		t.Fatalf("Expected 1 connection to game %d, got %s", game.Id, mustPrettyPrint(t, stats))
+	}
+
+	// Test 2: the hub stays up while the connection is open, and shuts down once it has been closed
+	time.Sleep(300 * time.Millisecond)
+	if _, ok := gameserver.GetConnectionStats().Games[game.Id]; !ok {
+		t.Fatalf("Expected the hub of game %d to be running", game.Id)
+	}
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := gameserver.GetConnectionStats().Games[game.Id]; !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the hub of game %d to shut down", game.Id)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// mustReadCloseCode reads from the connection until the server closes it, and returns the close code.
+func mustReadCloseCode(t *testing.T, conn *websocket.Conn) int {
+	// Don't answer the close message, as the server may already be gone.
+	conn.SetCloseHandler(func(int, string) error { return nil })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok {
+			t.Fatalf("Expected the connection to be closed, got %v", err)
+		}
+		return closeErr.Code
+	}
+}
+
+func TestWebSocketLimits(t *testing.T) {
+	config := gameserver.DefaultWebSocketConfig()
+	config.MaxMessageSize = 1024
+	config.MaxMessagesPerSecond = 1
+	config.MessageBurst = 3
+	config.PingInterval = 50 * time.Millisecond
+	config.PongTimeout = 200 * time.Millisecond
+	server := startWSServer(t, config)
+
+	// Test 1: messages that are too large are rejected
+	conn := mustDialWSURL(t, server)
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{Type: "SubscribeLobby", Message: string(make([]byte, 2048))})
+	if code := mustReadCloseCode(t, conn); code != websocket.CloseMessageTooBig {
+		t.Fatalf("Expected close code %d, got %d", websocket.CloseMessageTooBig, code)
+	}
+
+	// Test 2: sending messages too quickly closes the connection
+	conn = mustDialWSURL(t, server)
+	for i := 0; i < 5; i++ {
+		mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{Type: "UnsubscribeLobby"})
+	}
+	if code := mustReadCloseCode(t, conn); code != websocket.ClosePolicyViolation {
+		t.Fatalf("Expected close code %d, got %d", websocket.ClosePolicyViolation, code)
+	}
+
+	// Test 3: connections that answer pings stay open, and those that don't are dropped
+	conn = mustDialWSURL(t, server)
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, _, err := conn.ReadMessage(); !strings.Contains(fmt.Sprint(err), "timeout") {
+		t.Fatalf("Expected the connection answering pings to stay open, got %v", err)
+	}
+	conn = mustDialWSURL(t, server)
+	conn.SetPingHandler(func(string) error { return nil })
+	if code := mustReadCloseCode(t, conn); code != websocket.CloseGoingAway {
+		t.Fatalf("Expected close code %d, got %d", websocket.CloseGoingAway, code)
+	}
+}
+
+func TestSlowConnections(t *testing.T) {
+	config := gameserver.DefaultWebSocketConfig()
+	config.SendBufferSize = 4
+	config.WriteTimeout = 200 * time.Millisecond
+	server := startWSServer(t, config)
+
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user1, true, true)
+	mustJoinGame(t, user2, game)
+	url := fmt.Sprintf("http://localhost:1234/game/%d/actions", game.Id)
+	makeAction := func(num int) {
+		token := user1.Token
+		if num%2 == 0 {
+			token = user2.Token
+		}
+		action := fmt.Sprintf("%d%s", num, strings.Repeat("x", 16*1024))
+		resp := postObject(t, url, map[string]interface{}{"token": token, "action_num": num, "action": action})
+		if isErrorResponse(resp, "") {
+			t.Fatalf("Failed to make action %d: %s", num, resp)
+		}
+	}
+
+	// The slow connection stops reading once it has joined the game.
+	slow := mustDialWSURL(t, server)
+	mustSendWSMessageTo(t, slow, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, slow, "GameJoined")
+	fast := mustDialWS(t)
+	mustSendWSMessageTo(t, fast, &gameserver.WebSocketMessage{GameID: game.Id, Token: user2.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, fast, "GameJoined")
+	if n := gameserver.GetConnectionStats().Games[game.Id]; n != 2 {
+		t.Fatalf("Expected 2 connections to the game, got %d", n)
+	}
+
+	// Test 1: a connection that does not read is evicted, while the others keep receiving every action
+	num := 0
+	for gameserver.GetConnectionStats().Games[game.Id] > 1 {
+		if num++; num > 2000 {
+			t.Fatalf("Expected the slow connection to be evicted")
+		}
+		makeAction(num)
+		action := mustExtractMessage(t, mustReadWSMessageOfType(t, fast, "Action"))
+		if action["action_num"] != float64(num) {
+			t.Fatalf("Expected action %d, got %v", num, action["action_num"])
+		}
+	}
+
+	// Test 2: actions made after the eviction still reach the other connections
+	makeAction(num + 1)
+	if action := mustExtractMessage(t, mustReadWSMessageOfType(t, fast, "Action")); action["action_num"] != float64(num+1) {
+		t.Fatalf("Expected action %d, got %v", num+1, action["action_num"])
+	}
+
+	// Test 3: the slow connection has been closed
+	slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := slow.ReadMessage(); err != nil {
+			if strings.Contains(err.Error(), "timeout") {
+				t.Fatalf("Expected the slow connection to be closed, got %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestProtocolV2(t *testing.T) {
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user1, true, true)
+	mustJoinGame(t, user2, game)
+
+	// Test 1: the protocol can be negotiated with a subprotocol
+	dialer := websocket.Dialer{Subprotocols: []string{"gameserver.v2"}}
+	conn, _, err := dialer.Dial("ws://localhost:1234/game/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != "gameserver.v2" {
+		t.Fatalf("Expected subprotocol gameserver.v2, got %q", conn.Subprotocol())
+	}
+
+	readV2 := func(conn *websocket.Conn, messageType string) *gameserver.WebSocketMessageV2 {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var wsm gameserver.WebSocketMessageV2
+			if err := conn.ReadJSON(&wsm); err != nil {
+				t.Fatalf("Failed to read %s message: %v", messageType, err)
+			}
+			if wsm.Type == messageType {
+				return &wsm
+			}
+		}
+	}
+
+	// Test 2: payloads are JSON values rather than strings
+	if err := conn.WriteJSON(&gameserver.WebSocketMessageV2{GameID: game.Id, Token: user1.Token, Type: "Join"}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var joined struct {
+		Player   string `json:"player"`
+		GameType string `json:"game_type"`
+	}
+	if err := json.Unmarshal(readV2(conn, "GameJoined").Payload, &joined); err != nil {
+		t.Fatalf("Failed to unmarshal payload: %v", err)
+	}
+	if joined.Player != "white" || joined.GameType != "Gipf" {
+		t.Fatalf("Unexpected GameJoined payload: %s", mustPrettyPrint(t, joined))
+	}
+
+	// Test 3: v1 and v2 clients can play together, using the query parameter to choose v2
+	conn2, _, err := websocket.DefaultDialer.Dial("ws://localhost:1234/game/ws?protocol=2", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn2.Close()
+	conn1 := mustDialWS(t)
+	mustSendWSMessageTo(t, conn1, &gameserver.WebSocketMessage{GameID: game.Id, Token: user2.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, conn1, "GameJoined")
+	if err := conn2.WriteJSON(&gameserver.WebSocketMessageV2{GameID: game.Id, Token: user1.Token, Type: "Join"}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	readV2(conn2, "GameJoined")
+	if err := conn2.WriteJSON(&gameserver.WebSocketMessageV2{GameID: game.Id, Token: user1.Token, Type: "Action",
+		Payload: json.RawMessage(`{"action_num": 1, "action": "a"}`)}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var action gameserver.Action
+	if err := json.Unmarshal(readV2(conn2, "Action").Payload, &action); err != nil || action.Action != "a" {
+		t.Fatalf("Unexpected v2 action broadcast: %v %v", action, err)
+	}
+	if err := json.Unmarshal([]byte(mustReadWSMessageOfType(t, conn1, "Action").Message), &action); err != nil || action.ActionNum != 1 {
+		t.Fatalf("Unexpected v1 action broadcast: %v %v", action, err)
+	}
+
+	// Test 4: content that is not JSON is sent as a string, even if it looks like JSON
+	mustSendWSMessageTo(t, conn1, &gameserver.WebSocketMessage{GameID: game.Id, Token: user2.Token, Type: "GameOver", Message: "42"})
+	if payload := string(readV2(conn2, "GameOver").Payload); payload != `"42"` {
+		t.Fatalf("Expected the result as a JSON string, got %s", payload)
+	}
+}
+
+func TestProtocolMsgPack(t *testing.T) {
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user1, true, true)
+	mustJoinGame(t, user2, game)
+
+	dialer := websocket.Dialer{Subprotocols: []string{"gameserver.msgpack"}}
+	conn, _, err := dialer.Dial("ws://localhost:1234/game/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != "gameserver.msgpack" {
+		t.Fatalf("Expected subprotocol gameserver.msgpack, got %q", conn.Subprotocol())
+	}
+
+	write := func(wsm *gameserver.WebSocketMessageMsgPack) {
+		data, err := msgpack.Marshal(wsm)
+		if err != nil {
+			t.Fatalf("Failed to marshal message: %v", err)
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	read := func(messageType string) map[string]interface{} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			frameType, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("Failed to read %s message: %v", messageType, err)
+			}
+			if frameType != websocket.BinaryMessage {
+				t.Fatalf("Expected a binary message, got %d", frameType)
+			}
+			var wsm gameserver.WebSocketMessageMsgPack
+			if err := msgpack.Unmarshal(data, &wsm); err != nil {
+				t.Fatalf("Failed to unmarshal message: %v", err)
+			}
+			if wsm.Type != messageType {
+				continue
+			}
+			var payload map[string]interface{}
+			if err := msgpack.Unmarshal(wsm.Payload, &payload); err != nil {
+				t.Fatalf("Failed to unmarshal payload: %v", err)
+			}
+			return payload
+		}
+	}
+
+	// Test 1: payloads are MessagePack values
+	write(&gameserver.WebSocketMessageMsgPack{GameID: game.Id, Token: user1.Token, Type: "Join"})
+	if joined := read("GameJoined"); joined["player"] != "white" || joined["game_type"] != "Gipf" {
+		t.Fatalf("Unexpected GameJoined payload: %v", joined)
+	}
+
+	// Test 2: MessagePack and JSON clients can play together
+	conn1 := mustDialWS(t)
+	mustSendWSMessageTo(t, conn1, &gameserver.WebSocketMessage{GameID: game.Id, Token: user2.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, conn1, "GameJoined")
+	payload, _ := msgpack.Marshal(map[string]interface{}{"action_num": 1, "action": "a"})
+	write(&gameserver.WebSocketMessageMsgPack{GameID: game.Id, Token: user1.Token, Type: "Action", Payload: payload})
+	if action := read("ActionAccepted"); fmt.Sprint(action["action_num"]) != "1" {
+		t.Fatalf("Unexpected acknowledgement: %v", action)
+	}
+	var action gameserver.Action
+	if err := json.Unmarshal([]byte(mustReadWSMessageOfType(t, conn1, "Action").Message), &action); err != nil || action.Action != "a" {
+		t.Fatalf("Unexpected JSON action broadcast: %v %v", action, err)
+	}
+	mustSendWSMessageTo(t, conn1, &gameserver.WebSocketMessage{GameID: game.Id, Token: user2.Token, Type: "Action",
+		Message: `{"action_num": 2, "action": "b"}`})
+	if action := read("Action"); action["action"] != "b" {
+		t.Fatalf("Unexpected MessagePack action broadcast: %v", action)
+	}
+
+	// Test 3: content that is not JSON is sent as a string, even if it looks like JSON
+	mustSendWSMessageTo(t, conn1, &gameserver.WebSocketMessage{GameID: game.Id, Token: user2.Token, Type: "GameOver", Message: "true"})
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read GameOver message: %v", err)
+		}
+		var wsm gameserver.WebSocketMessageMsgPack
+		if err := msgpack.Unmarshal(data, &wsm); err != nil || wsm.Type != "GameOver" {
+			continue
+		}
+		var result interface{}
+		if err := msgpack.Unmarshal(wsm.Payload, &result); err != nil || result != "true" {
+			t.Fatalf("Expected the result as a string, got %v: %v", result, err)
+		}
+		break
+	}
+
+	// Test 4: text messages are rejected on a MessagePack connection
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{}`)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if code := mustReadCloseCode(t, conn); code != websocket.CloseUnsupportedData {
+		t.Fatalf("Expected close code %d, got %d", websocket.CloseUnsupportedData, code)
+	}
+}
+
+func TestRequestCorrelation(t *testing.T) {
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user1, true, true)
+	mustJoinGame(t, user2, game)
+	conn := mustDialWS(t)
+
+	// Test 1: replies echo the request id
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Join", RequestID: "join-1"})
+	if resp := mustReadWSMessageOfType(t, conn, "GameJoined"); resp.RequestID != "join-1" {
+		t.Fatalf("Expected request id join-1, got %q", resp.RequestID)
+	}
+
+	// Test 2: an accepted action is acknowledged separately from its broadcast
+	action, _ := json.Marshal(&gameserver.Action{ActionNum: 1, Action: "a"})
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Action", Message: string(action), RequestID: "action-1"})
+	if resp := mustReadWSMessageOfType(t, conn, "Action"); resp.RequestID != "" {
+		t.Fatalf("Expected no request id in the broadcast, got %q", resp.RequestID)
+	}
+	ack := mustReadWSMessageOfType(t, conn, "ActionAccepted")
+	if ack.RequestID != "action-1" || mustExtractMessage(t, ack)["action_num"] != float64(1) {
+		t.Fatalf("Unexpected acknowledgement: %s", mustPrettyPrint(t, ack))
+	}
+
+	// Test 3: errors carry the request id and a machine-readable code
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Action", Message: string(action), RequestID: "action-2"})
+	resp := mustReadWSMessageOfType(t, conn, "Error")
+	if resp.RequestID != "action-2" || resp.ErrorCode != gameserver.ErrorConflict {
+		t.Fatalf("Unexpected error: %s", mustPrettyPrint(t, resp))
+	}
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Nonsense", RequestID: "nonsense"})
+	resp = mustReadWSMessageOfType(t, conn, "Error")
+	if resp.RequestID != "nonsense" || resp.ErrorCode != gameserver.ErrorUnknownMessageType {
+		t.Fatalf("Unexpected error: %s", mustPrettyPrint(t, resp))
+	}
+}
+
+func TestIdempotentActions(t *testing.T) {
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user1, true, true)
+	mustJoinGame(t, user2, game)
+	conn := mustDialWS(t)
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, conn, "GameJoined")
+
+	send := func(action *gameserver.Action) {
+		data, _ := json.Marshal(action)
+		mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Action", Message: string(data)})
+	}
+
+	// Test 1: resending the same action is acknowledged as a duplicate and not saved again
+	send(&gameserver.Action{ActionNum: 1, Action: "a", ClientActionID: "id-1"})
+	mustReadWSMessageOfType(t, conn, "ActionAccepted")
+	send(&gameserver.Action{ActionNum: 1, Action: "a", ClientActionID: "id-1"})
+	ack := mustExtractMessage(t, mustReadWSMessageOfType(t, conn, "ActionAccepted"))
+	if ack["duplicate"] != true {
+		t.Fatalf("Expected a duplicate acknowledgement, got %s", mustPrettyPrint(t, ack))
+	}
+	if num, err := gameserver.GetNumberOfActions(game.Id); err != nil || num != 1 {
+		t.Fatalf("Expected 1 action, got %d (%v)", num, err)
+	}
+
+	// Test 2: a different action with the same number or id is a conflict
+	send(&gameserver.Action{ActionNum: 1, Action: "b", ClientActionID: "id-2"})
+	if resp := mustReadWSMessageOfType(t, conn, "Error"); resp.ErrorCode != gameserver.ErrorConflict {
+		t.Fatalf("Expected a conflict, got %s", mustPrettyPrint(t, resp))
+	}
+	send(&gameserver.Action{ActionNum: 2, Action: "b", ClientActionID: "id-1"})
+	if resp := mustReadWSMessageOfType(t, conn, "Error"); resp.ErrorCode != gameserver.ErrorConflict {
+		t.Fatalf("Expected a conflict, got %s", mustPrettyPrint(t, resp))
+	}
+}
+
+func TestConcurrentActions(t *testing.T) {
+	const numConns, numActions = 8, 20
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user1, true, true)
+	mustJoinGame(t, user2, game)
+
+	conns := make([]*websocket.Conn, numConns)
+	tokens := make([]gameserver.Token, numConns)
+	for i := range conns {
+		conns[i] = mustDialWS(t)
+		tokens[i] = user1.Token
+		if i%2 == 1 {
+			tokens[i] = user2.Token
+		}
+		mustSendWSMessageTo(t, conns[i], &gameserver.WebSocketMessage{GameID: game.Id, Token: tokens[i], Type: "Join"})
+		mustReadWSMessageOfType(t, conns[i], "GameJoined")
+	}
+
+	// Every connection tries to make every action of its player; each action must be accepted exactly once,
+	// and all other attempts must be rejected as conflicts. Black's connections retry an action until white's
+	// action before it has been made, and vice versa.
+	accepted := make([][]int, numConns)
+	errs := make(chan error, numConns)
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn := conns[i]
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			for num, attempt := 1+i%2, 0; num <= numActions; attempt++ {
+				data, _ := json.Marshal(&gameserver.Action{ActionNum: num, Action: fmt.Sprintf("%d-%d", i, num)})
+				requestID := fmt.Sprintf("%d-%d-%d", i, num, attempt)
+				err := conn.WriteJSON(&gameserver.WebSocketMessage{GameID: game.Id, Token: tokens[i], Type: "Action", Message: string(data), RequestID: requestID})
+				if err != nil {
+					errs <- err
+					return
+				}
+				for {
+					var resp gameserver.WebSocketMessage
+					if err := conn.ReadJSON(&resp); err != nil {
+						errs <- err
+						return
+					}
+					if resp.RequestID != requestID {
+						continue
+					}
+					if resp.Type == "ActionAccepted" {
+						accepted[i] = append(accepted[i], num)
+					} else if resp.Type == "Error" && resp.ErrorCode == gameserver.ErrorInvalidActionNumber {
+						time.Sleep(time.Millisecond)
+						break
+					} else if resp.Type != "Error" || resp.ErrorCode != gameserver.ErrorConflict {
+						errs <- fmt.Errorf("unexpected reply to action %d: %s %s", num, resp.Type, resp.Message)
+						return
+					}
+					num += 2
+					break
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	count := make(map[int]int)
+	for _, nums := range accepted {
+		for _, num := range nums {
+			count[num]++
+		}
+	}
+	for num := 1; num <= numActions; num++ {
+		if count[num] != 1 {
+			t.Fatalf("Expected action %d to be accepted once, got %d", num, count[num])
+		}
+	}
+	if num, err := gameserver.GetNumberOfActions(game.Id); err != nil || num != numActions {
+		t.Fatalf("Expected %d actions, got %d (%v)", numActions, num, err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	user1 := mustRegisterAndAuthenticateRandomUser(t)
+	user2 := mustRegisterAndAuthenticateRandomUser(t)
+	game := mustCreateGame(t, user1, true, true)
+	mustJoinGame(t, user2, game)
+	conn := mustDialWS(t)
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Join"})
+	mustReadWSMessageOfType(t, conn, "GameJoined")
+
+	// Test 1: games in progress cannot be replayed
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Replay"})
+	if resp := mustReadWSMessageOfType(t, conn, "Error"); resp.ErrorCode != gameserver.ErrorNotAllowed {
+		t.Fatalf("Unexpected error: %s", mustPrettyPrint(t, resp))
+	}
+
+	// Test 2: actions are replayed with the recorded pauses, at the requested speed
+	for i, move := range []string{"a", "b", "c"} {
+		token := user1.Token
+		if i%2 == 1 {
+			token = user2.Token
+		}
+		data, _ := json.Marshal(&gameserver.Action{ActionNum: i + 1, Action: move})
+		mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: token, Type: "Action", Message: string(data)})
+		mustReadWSMessageOfType(t, conn, "ActionAccepted")
+	}
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "GameOver", Message: "Draw"})
+	mustReadWSMessageOfType(t, conn, "GameOver")
+	err := gameserver.ExecuteSQL("UPDATE actions SET creation_time = 1000000 + action_num * 2000 WHERE game_id = ?", game.Id)
+	if err != nil {
+		t.Fatalf("Failed to update action times: %v", err)
+	}
+	start := time.Now()
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: user1.Token, Type: "Replay",
+		Message: `{"speed": 20}`, RequestID: "replay"})
+	if resp := mustExtractMessage(t, mustReadWSMessageOfType(t, conn, "ReplayStarted")); resp["num_actions"] != float64(3) {
+		t.Fatalf("Unexpected replay start: %v", resp)
+	}
+	var moves []string
+	for len(moves) < 3 {
+		resp := mustReadWSMessageOfType(t, conn, "ReplayAction")
+		if resp.RequestID != "replay" {
+			t.Fatalf("Expected request id replay, got %q", resp.RequestID)
+		}
+		moves = append(moves, mustExtractMessage(t, resp)["action"].(string))
+	}
+	if strings.Join(moves, " ") != "a b c" || time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("Unexpected replay after %v: %v", time.Since(start), moves)
+	}
+	if resp := mustExtractMessage(t, mustReadWSMessageOfType(t, conn, "ReplayFinished")); resp["game_result"] != "Draw" {
+		t.Fatalf("Unexpected replay end: %v", resp)
+	}
+
+	// Test 3: long replays without pauses do not overflow the queue of the connection, and actions without
+	// signatures are replayed
+	moves = make([]string, 20)
+	for i := range moves {
+		moves[i] = strconv.Itoa(i)
+	}
+	game = mustPlayGame(t, moves, "Draw")
+	if err := gameserver.ExecuteSQL("UPDATE actions SET action_signature = NULL WHERE game_id = ?", game.Id); err != nil {
+		t.Fatalf("Failed to update action signatures: %v", err)
+	}
+	config := gameserver.DefaultWebSocketConfig()
+	config.SendBufferSize = 4
+	conn = mustDialWSURL(t, startWSServer(t, config))
+	mustSendWSMessageTo(t, conn, &gameserver.WebSocketMessage{GameID: game.Id, Token: game.WhiteToken, Type: "Replay",
+		Message: `{"max_delay": 1}`})
+	mustReadWSMessageOfType(t, conn, "ReplayStarted")
+	for i := range moves {
+		if action := mustExtractMessage(t, mustReadWSMessageOfType(t, conn, "ReplayAction")); action["action"] != moves[i] {
+			t.Fatalf("Expected action %s, got %v", moves[i], action)
+		}
+	}
+	mustReadWSMessageOfType(t, conn, "ReplayFinished")
+}